@@ -0,0 +1,283 @@
+// bench_test.go -- benchmarks for the android/pkg parsers
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The whole-document model parseXML used before it was streamed
+type xPackage struct {
+	XMLName xml.Name      `xml:"packages"`
+	Ver     []xPackageVer `xml:"version"`
+
+	Pkgs []xpkg `xml:"package"`
+}
+
+func readFixture(b testing.TB, fn string) []byte {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		b.Fatalf("%s", err)
+	}
+	return data
+}
+
+// Streaming decode of packages.xml
+func BenchmarkParseXML(b *testing.B) {
+	data := readFixture(b, "../packages.xml")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseXML(bytes.NewReader(data), "packages.xml", &defaultConfig, nil); err != nil {
+			b.Fatalf("%s", err)
+		}
+	}
+}
+
+// Parse again with the certs from a previous parse - like a refresh
+func BenchmarkParseXMLCached(b *testing.B) {
+	data := readFixture(b, "../packages.xml")
+
+	xx, err := parseXML(bytes.NewReader(data), "packages.xml", &defaultConfig, nil)
+	if err != nil {
+		b.Fatalf("%s", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseXML(bytes.NewReader(data), "packages.xml", &defaultConfig, xx.certs); err != nil {
+			b.Fatalf("%s", err)
+		}
+	}
+}
+
+// Names only: every cert is parsed up front
+func BenchmarkNames(b *testing.B) {
+	benchNames(b)
+}
+
+// Names only: the certs are never parsed
+func BenchmarkNamesLazy(b *testing.B) {
+	benchNames(b, WithLazyCerts(true))
+}
+
+func benchNames(b *testing.B, opts ...Option) {
+	xml := readFixture(b, "../packages.xml")
+	list := readFixture(b, "../packages.list")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db, err := OpenPackageDBReader(bytes.NewReader(xml), bytes.NewReader(list), opts...)
+		if err != nil {
+			b.Fatalf("%s", err)
+		}
+		if len(db.Names()) == 0 {
+			b.Fatalf("no packages")
+		}
+	}
+}
+
+// Read the whole file and unmarshal the entire tree before converting
+func BenchmarkParseXMLUnmarshal(b *testing.B) {
+	data := readFixture(b, "../packages.xml")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := io.ReadAll(bytes.NewReader(data))
+		if err != nil {
+			b.Fatalf("%s", err)
+		}
+
+		var v xPackage
+		if err := xml.Unmarshal(buf, &v); err != nil {
+			b.Fatalf("%s", err)
+		}
+
+		keys := newCertTab(nil)
+		for _, x := range v.Pkgs {
+			if _, err := x.toPkg(keys); err != nil {
+				b.Fatalf("%s", err)
+			}
+		}
+	}
+}
+
+// The channel based line splitter parseList used before bufio.Scanner
+func genlines(ifd io.Reader) chan []byte {
+	rr := bufio.NewReader(ifd)
+	ch := make(chan []byte, 10)
+
+	fn := func(r *bufio.Reader, ch chan []byte) {
+		for {
+			b, err := r.ReadBytes('\n')
+			x := len(b)
+			if x == 0 {
+				if err == io.EOF {
+					break
+				}
+				continue
+			}
+
+			if b[x-1] == '\n' {
+				b = b[:x-1]
+				x -= 1
+			}
+
+			if x == 0 {
+				continue
+			}
+
+			if b[x-1] == '\r' {
+				b = b[:x-1]
+				x -= 1
+			}
+
+			if x == 0 {
+				continue
+			}
+
+			ch <- b
+		}
+		close(ch)
+	}
+
+	go fn(rr, ch)
+
+	return ch
+}
+
+// A large packages.list made from many copies of the device fixture
+func bigList(b *testing.B) []byte {
+	data := readFixture(b, "../packages.list")
+	return bytes.Repeat(data, 200)
+}
+
+// Repeat the <package> elements of the fixture to get a packages.xml
+// that takes about as long to parse as bigList(); the refresh benchmarks
+// only show the overlap when neither file dominates.
+func bigXML(b *testing.B) []byte {
+	data := readFixture(b, "../packages.xml")
+	i := bytes.Index(data, []byte("    <package "))
+	j := bytes.LastIndex(data, []byte("</package>\n"))
+	if i < 0 || j < i {
+		b.Fatalf("can't find the packages in packages.xml")
+	}
+	j += len("</package>\n")
+
+	var buf bytes.Buffer
+	buf.Write(data[:i])
+	buf.Write(bytes.Repeat(data[i:j], 2))
+	buf.Write(data[j:])
+	return buf.Bytes()
+}
+
+func BenchmarkParseList(b *testing.B) {
+	data := bigList(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := parseList(bytes.NewReader(data), "packages.list", &defaultConfig); err != nil {
+			b.Fatalf("%s", err)
+		}
+	}
+}
+
+// Split lines with the old go routine + channel
+func BenchmarkLinesChan(b *testing.B) {
+	data := bigList(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for l := range genlines(bytes.NewReader(data)) {
+			_ = bytes.Fields(l)
+		}
+	}
+}
+
+// Split lines with bufio.Scanner
+func BenchmarkLinesScanner(b *testing.B) {
+	data := bigList(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		sc.Buffer(make([]byte, 0, 4096), maxListLine)
+		for sc.Scan() {
+			_ = bytes.Fields(sc.Bytes())
+		}
+	}
+}
+
+// Make a DB backed by large copies of the fixtures
+func bigDB(b *testing.B) *PackageDB {
+	dir := b.TempDir()
+	list := filepath.Join(dir, "packages.list")
+	xml := filepath.Join(dir, "packages.xml")
+
+	if err := os.WriteFile(list, bigList(b), 0600); err != nil {
+		b.Fatalf("%s", err)
+	}
+	if err := os.WriteFile(xml, bigXML(b), 0600); err != nil {
+		b.Fatalf("%s", err)
+	}
+
+	db := newDB(nil)
+	db.list = list
+	db.xml = xml
+	return db
+}
+
+func BenchmarkRefresh(b *testing.B) {
+	db := bigDB(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.refresh(); err != nil {
+			b.Fatalf("%s", err)
+		}
+	}
+}
+
+// Parse the files one after the other
+func BenchmarkRefreshSerial(b *testing.B) {
+	db := bigDB(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ll, _, err := db.parseListFile(&db.cfg)
+		if err != nil {
+			b.Fatalf("%s", err)
+		}
+		xx, err := db.parseXMLFile(&db.cfg)
+		if err != nil {
+			b.Fatalf("%s", err)
+		}
+		db.load(xx, ll)
+	}
+}
@@ -0,0 +1,191 @@
+// cert.go -- signing certificate helpers for Android packages
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A DER encoded cert that is parsed at most once, when first needed;
+// it is shared by every package signed with it.
+type lazyCert struct {
+	der []byte
+
+	once sync.Once
+	crt  *x509.Certificate
+	err  error
+}
+
+// Return the parsed cert
+func (c *lazyCert) get() (*x509.Certificate, error) {
+	c.once.Do(func() {
+		c.crt, c.err = x509.ParseCertificate(c.der)
+		if c.err != nil {
+			c.err = fmt.Errorf("Can't parse X509 DER cert: %w", c.err)
+		}
+	})
+	return c.crt, c.err
+}
+
+// Return the package's signing cert, parsing it if WithLazyCerts()
+// deferred that; nil if the package has no cert.
+func (p *Pkg) Certificate() (*x509.Certificate, error) {
+	if p.Cert != nil || len(p.certs) == 0 {
+		return p.Cert, nil
+	}
+	return p.certs[0].get()
+}
+
+// Return the signing cert; nil if there is none or it won't parse
+func (p *Pkg) cert() *x509.Certificate {
+	c, _ := p.Certificate()
+	return c
+}
+
+// Return true if the package has a signing cert, parsed or not
+func (p *Pkg) hasCert() bool {
+	return p.Cert != nil || len(p.certs) > 0
+}
+
+// Return the DER encoding of the package's certs and its signing
+// lineage
+func (p *Pkg) certDERs() (certs, lineage [][]byte) {
+	if len(p.Certs) == 0 && len(p.certs) > 0 {
+		for _, c := range p.certs {
+			certs = append(certs, c.der)
+		}
+		for _, c := range p.lineage {
+			lineage = append(lineage, c.der)
+		}
+		return certs, lineage
+	}
+
+	for _, c := range p.Certs {
+		certs = append(certs, c.Raw)
+	}
+	for _, c := range p.SigningLineage {
+		lineage = append(lineage, c.Raw)
+	}
+	return certs, lineage
+}
+
+// Return true if the package's signing cert is not valid at time
+// 'at' - either expired or not yet valid. Packages without a cert
+// return false.
+func (p *Pkg) CertExpired(at time.Time) bool {
+	c := p.cert()
+	if c == nil {
+		return false
+	}
+
+	return at.Before(c.NotBefore) || at.After(c.NotAfter)
+}
+
+// Return how long the package's signing cert remains valid after
+// time 'at'; zero if it has expired or there is no cert.
+func (p *Pkg) CertValidityRemaining(at time.Time) time.Duration {
+	c := p.cert()
+	if c == nil || at.After(c.NotAfter) {
+		return 0
+	}
+
+	return c.NotAfter.Sub(at)
+}
+
+// Return the packages whose signing cert is not valid at time 'at',
+// sorted by name
+func (db *PackageDB) ExpiredCerts(at time.Time) []*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var pv []*Pkg
+	for _, p := range sortedPkgs(db.byName) {
+		if p.CertExpired(at) {
+			pv = append(pv, p)
+		}
+	}
+	return pv
+}
+
+// Return true if the package is signed with an Android debug key: its
+// cert subject is the "CN=Android Debug,O=Android,C=US" of the debug
+// keystore made by the SDK. False if there's no cert.
+func (p *Pkg) IsDebugSigned() bool {
+	c := p.cert()
+	if c == nil {
+		return false
+	}
+
+	s := &c.Subject
+	return len(s.Names) == 3 && s.CommonName == "Android Debug" &&
+		slices.Equal(s.Organization, []string{"Android"}) &&
+		slices.Equal(s.Country, []string{"US"})
+}
+
+// Return the packages signed with an Android debug key sorted by name
+func (db *PackageDB) DebugSignedPackages() []*Pkg {
+	return db.FilterFunc((*Pkg).IsDebugSigned)
+}
+
+// Return true if p and other are signed with the same key. Only the
+// public keys are compared - so certs with different serials or
+// validity but the same key are the same signer.
+func (p *Pkg) SameSigner(other *Pkg) bool {
+	a, b := p.cert(), other.cert()
+	if a == nil || b == nil {
+		return false
+	}
+
+	return bytes.Equal(a.RawSubjectPublicKeyInfo, b.RawSubjectPublicKeyInfo)
+}
+
+// Return the key used to group packages by signer: the hex SHA256 of
+// the signing public key; empty if there's no cert.
+func signerKey(p *Pkg) string {
+	c := p.cert()
+	if c == nil {
+		return ""
+	}
+
+	h := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(h[:])
+}
+
+// Group packages by signer; the map key is the hex SHA256 of the
+// signing public key and each group is sorted by name. Packages
+// without a cert are left out.
+func (db *PackageDB) GroupBySigner() map[string][]*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	m := make(map[string][]*Pkg)
+	for _, p := range sortedPkgs(db.byName) {
+		if k := signerKey(p); len(k) > 0 {
+			m[k] = append(m[k], p)
+		}
+	}
+	return m
+}
@@ -0,0 +1,54 @@
+// debug_windows.go -- debugging hooks for Windows
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build windows
+// +build windows
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"fmt"
+	"hash/fnv"
+	"syscall"
+)
+
+// Return the calling user as a pseudo package. Windows has no uids;
+// we hash the user's SID down to a uint32 instead.
+func getself() *Pkg {
+	var uid uint32
+
+	if sid, err := usersid(); err == nil {
+		h := fnv.New32a()
+		h.Write([]byte(sid))
+		uid = h.Sum32()
+	}
+
+	nm := fmt.Sprintf("caller-uid-%v", uid)
+	return &Pkg{Name: nm, Uid: uid}
+}
+
+// Return the string form of the calling user's SID
+func usersid() (string, error) {
+	tok, err := syscall.OpenCurrentProcessToken()
+	if err != nil {
+		return "", err
+	}
+	defer tok.Close()
+
+	u, err := tok.GetTokenUser()
+	if err != nil {
+		return "", err
+	}
+	return u.User.Sid.String()
+}
@@ -0,0 +1,192 @@
+// diff.go -- compare two snapshots of the package DB
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"maps"
+	"slices"
+)
+
+// Differences between two package DBs. Each list is sorted by package
+// name; Changed holds the packages from the newer DB.
+type DiffResult struct {
+	Added   []*Pkg
+	Removed []*Pkg
+	Changed []*Pkg
+}
+
+// Compare db against an older snapshot 'old' and return what was
+// added, removed or changed. A package has changed if its version,
+// uid or cert hash differs.
+func (db *PackageDB) Diff(old *PackageDB) *DiffResult {
+	db.maybeRefresh()
+	old.maybeRefresh()
+
+	// The maps are never modified in place; holding on to them
+	// outside the lock is safe.
+	db.mu.RLock()
+	cur := db.byName
+	db.mu.RUnlock()
+
+	old.mu.RLock()
+	prev := old.byName
+	old.mu.RUnlock()
+
+	d := &DiffResult{}
+	for _, p := range sortedPkgs(cur) {
+		o, ok := prev[p.Name]
+		if !ok {
+			d.Added = append(d.Added, p)
+			continue
+		}
+
+		if p.Uid != o.Uid || p.Version != o.Version || p.VersionCode != o.VersionCode ||
+			!bytes.Equal(p.Certhash, o.Certhash) {
+			d.Changed = append(d.Changed, p)
+		}
+	}
+
+	for _, p := range sortedPkgs(prev) {
+		if _, ok := cur[p.Name]; !ok {
+			d.Removed = append(d.Removed, p)
+		}
+	}
+
+	return d
+}
+
+// Return a SHA256 fingerprint of the DB contents: the name, uid,
+// version and cert hash of every package. DBs with the same contents
+// have the same hash regardless of the order of the input files; this
+// is the cheap way to tell if a Diff() will find anything.
+func (db *PackageDB) ContentHash() []byte {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	pv := sortedPkgs(db.byName)
+	db.mu.RUnlock()
+
+	var b [8]byte
+	h := sha256.New()
+
+	// length prefix each variable length field so that adjacent fields
+	// can't run into each other
+	str := func(s []byte) {
+		binary.BigEndian.PutUint32(b[:4], uint32(len(s)))
+		h.Write(b[:4])
+		h.Write(s)
+	}
+
+	for _, p := range pv {
+		if p.pseudo {
+			continue
+		}
+
+		str([]byte(p.Name))
+		binary.BigEndian.PutUint32(b[:4], p.Uid)
+		h.Write(b[:4])
+		str([]byte(p.Version))
+		binary.BigEndian.PutUint64(b[:], uint64(p.VersionCode))
+		h.Write(b[:])
+		str(p.Certhash)
+	}
+	return h.Sum(nil)
+}
+
+// Return true if p and other describe the same package. Every
+// exported field is compared; certs are compared by their DER bytes
+// and the order of the gids doesn't matter.
+func (p *Pkg) Equal(other *Pkg) bool {
+	if p == other {
+		return true
+	}
+	if p == nil || other == nil {
+		return false
+	}
+
+	if p.Name != other.Name || p.DataPath != other.DataPath || p.Path != other.Path ||
+		p.Uid != other.Uid || p.SharedUid != other.SharedUid ||
+		p.NativeLibraryPath != other.NativeLibraryPath || p.PrimaryCpuAbi != other.PrimaryCpuAbi ||
+		p.SecondaryCpuAbi != other.SecondaryCpuAbi || p.CpuAbiOverride != other.CpuAbiOverride ||
+		p.VolumeUuid != other.VolumeUuid || p.SEinfo != other.SEinfo || p.SEinfoUser != other.SEinfoUser ||
+		p.Debug != other.Debug || p.Version != other.Version || p.VersionCode != other.VersionCode ||
+		p.Flags != other.Flags || p.Enabled != other.Enabled || p.Installer != other.Installer ||
+		p.InitiatingInstaller != other.InitiatingInstaller || p.OriginatingInstaller != other.OriginatingInstaller ||
+		p.InstallReason != other.InstallReason || p.IsOrphaned != other.IsOrphaned ||
+		p.SignerCount != other.SignerCount {
+		return false
+	}
+
+	if !p.FirstInstallTime.Equal(other.FirstInstallTime) || !p.LastUpdateTime.Equal(other.LastUpdateTime) {
+		return false
+	}
+
+	if !slices.Equal(sortedGids(p.Gid), sortedGids(other.Gid)) ||
+		!slices.Equal(p.Splits, other.Splits) ||
+		!slices.Equal(p.DisabledComponents, other.DisabledComponents) ||
+		!slices.Equal(p.EnabledComponents, other.EnabledComponents) ||
+		!slices.Equal(p.Permissions, other.Permissions) ||
+		!slices.Equal(p.SignatureSchemes, other.SignatureSchemes) {
+		return false
+	}
+
+	if !bytes.Equal(p.signingDER(), other.signingDER()) || !bytes.Equal(p.Certhash, other.Certhash) ||
+		!bytes.Equal(p.Certhash256, other.Certhash256) ||
+		!slices.EqualFunc(p.CertHashes, other.CertHashes, bytes.Equal) {
+		return false
+	}
+
+	pc, pl := p.certDERs()
+	oc, ol := other.certDERs()
+	if !slices.EqualFunc(pc, oc, bytes.Equal) || !slices.EqualFunc(pl, ol, bytes.Equal) {
+		return false
+	}
+
+	return keySetEqual(p.SigningKeySet, other.SigningKeySet) &&
+		maps.EqualFunc(p.KeySetAliases, other.KeySetAliases, keySetEqual)
+}
+
+// Return true if p sorts before other: by name and then by uid
+func (p *Pkg) Less(other *Pkg) bool {
+	if p.Name != other.Name {
+		return p.Name < other.Name
+	}
+	return p.Uid < other.Uid
+}
+
+// Return the DER encoding of the signing cert
+func (p *Pkg) signingDER() []byte {
+	if p.Cert != nil {
+		return p.Cert.Raw
+	}
+	return p.CertDER
+}
+
+// Return the distinct gids in ascending order
+func sortedGids(gid []uint32) []uint32 {
+	v := slices.Clone(gid)
+	slices.Sort(v)
+	return slices.Compact(v)
+}
+
+func keySetEqual(a, b *KeySet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.ID == b.ID && slices.EqualFunc(a.Keys, b.Keys, bytes.Equal)
+}
@@ -0,0 +1,92 @@
+// find.go -- search packages by name pattern
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"path"
+	"strings"
+)
+
+// Return all packages whose name starts with 'prefix' sorted by name
+func (db *PackageDB) FindByPrefix(prefix string) []*Pkg {
+	pv, _ := db.find(func(nm string) (bool, error) {
+		return strings.HasPrefix(nm, prefix), nil
+	})
+	return pv
+}
+
+// Return all packages whose name matches the shell pattern 'pat'
+// (with path.Match semantics) sorted by name. A malformed pattern
+// returns path.ErrBadPattern.
+func (db *PackageDB) FindByGlob(pat string) ([]*Pkg, error) {
+	// Match doesn't always look at the whole pattern
+	if _, err := path.Match(pat, ""); err != nil {
+		return nil, err
+	}
+
+	return db.find(func(nm string) (bool, error) {
+		return path.Match(pat, nm)
+	})
+}
+
+// Return all packages whose name matches 'nm' ignoring case (per
+// strings.EqualFold) sorted by name. Android package names are case
+// sensitive; use GetByName() for exact matches.
+func (db *PackageDB) FindByNameFold(nm string) []*Pkg {
+	pv, _ := db.find(func(s string) (bool, error) {
+		return strings.EqualFold(s, nm), nil
+	})
+	return pv
+}
+
+// Return all packages for which 'pred' is true sorted by name. The
+// packages are gathered under the read lock but 'pred' is called
+// without it, so it is free to use the Pkg methods.
+func (db *PackageDB) FilterFunc(pred func(p *Pkg) bool) []*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	pv := sortedPkgs(db.byName)
+	db.mu.RUnlock()
+
+	var r []*Pkg
+	for _, p := range pv {
+		if pred(p) {
+			r = append(r, p)
+		}
+	}
+	return r
+}
+
+// Return the packages whose names satisfy 'match' sorted by name
+func (db *PackageDB) find(match func(nm string) (bool, error)) ([]*Pkg, error) {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	pv := sortedPkgs(db.byName)
+	db.mu.RUnlock()
+
+	var r []*Pkg
+	for _, p := range pv {
+		ok, err := match(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			r = append(r, p)
+		}
+	}
+	return r, nil
+}
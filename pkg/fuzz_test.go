@@ -0,0 +1,70 @@
+// fuzz_test.go -- fuzz the android/pkg parsers
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package pkg
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// Seed the corpus with the fixtures matching 'pat'
+func addFixtures(f *testing.F, pat ...string) {
+	for _, p := range pat {
+		names, err := filepath.Glob(p)
+		if err != nil {
+			f.Fatalf("%s", err)
+		}
+		for _, fn := range names {
+			f.Add(readFixture(f, fn))
+		}
+	}
+}
+
+// The parsers must never panic; malformed input is an error
+func FuzzParseList(f *testing.F) {
+	addFixtures(f, "testdata/*.list", "testdata/*.list.gz", "../packages.list")
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, strict := range []bool{true, false} {
+			cfg := defaultConfig
+			cfg.strict = strict
+
+			pv, _, err := parseList(bytes.NewReader(b), "packages.list", &cfg)
+			if err == nil {
+				for _, p := range pv {
+					if len(p.Name) == 0 {
+						t.Fatalf("empty package name")
+					}
+				}
+			}
+		}
+	})
+}
+
+func FuzzParseXML(f *testing.F) {
+	addFixtures(f, "testdata/*.xml", "testdata/*.xml.gz", "../packages.xml")
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, strict := range []bool{true, false} {
+			cfg := defaultConfig
+			cfg.strict = strict
+
+			xx, err := parseXML(bytes.NewReader(b), "packages.xml", &cfg, nil)
+			if err == nil && xx == nil {
+				t.Fatalf("nil DB without an error")
+			}
+		}
+	})
+}
@@ -0,0 +1,124 @@
+// json.go -- JSON encoding of Android packages
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// JSON representation of a Pkg
+type jsonPkg struct {
+	Name     string   `json:"name"`
+	Uid      uint32   `json:"uid"`
+	Path     string   `json:"path,omitempty"`
+	DataPath string   `json:"data_path,omitempty"`
+	Gid      []uint32 `json:"gid,omitempty"`
+	SEinfo   string   `json:"seinfo,omitempty"`
+	CertCN   string   `json:"cert_cn,omitempty"`
+	Certhash string   `json:"certhash,omitempty"`
+}
+
+// JSON representation of a PackageDB
+type jsonDB struct {
+	Header   Header `json:"header"`
+	Packages []*Pkg `json:"packages"`
+}
+
+func (p *Pkg) toJSON() *jsonPkg {
+	j := &jsonPkg{
+		Name:     p.Name,
+		Uid:      p.Uid,
+		Path:     p.Path,
+		DataPath: p.DataPath,
+		Gid:      p.Gid,
+		SEinfo:   p.SEinfo,
+	}
+
+	if c := p.cert(); c != nil {
+		j.CertCN = c.Subject.CommonName
+	}
+	if len(p.Certhash) > 0 {
+		j.Certhash = hex.EncodeToString(p.Certhash)
+	}
+	return j
+}
+
+// MarshalJSON implements json.Marshaler
+func (p *Pkg) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.toJSON())
+}
+
+// MarshalJSON implements json.Marshaler; the packages are emitted in
+// sorted order of their names. Like WriteJSONL, the calling process
+// (see WithSelf) isn't included.
+func (db *PackageDB) MarshalJSON() ([]byte, error) {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	pv := sortedPkgs(db.byName)
+	j := jsonDB{Header: db.hdr}
+	db.mu.RUnlock()
+
+	j.Packages = make([]*Pkg, 0, len(pv))
+	for _, p := range pv {
+		if !p.pseudo {
+			j.Packages = append(j.Packages, p)
+		}
+	}
+	return json.Marshal(&j)
+}
+
+// Write the DB to 'w' as JSON lines: one package per line (encoded
+// like Pkg.MarshalJSON) sorted by name. The packages are encoded one
+// at a time rather than as one big array. The calling process (see
+// WithSelf) isn't written.
+func (db *PackageDB) WriteJSONL(w io.Writer) error {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	pv := sortedPkgs(db.byName)
+	db.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	e := json.NewEncoder(bw)
+	for _, p := range pv {
+		if p.pseudo {
+			continue
+		}
+
+		// Encode() adds the newline
+		if err := e.Encode(p.toJSON()); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Return the packages in 'm' sorted by name
+func sortedPkgs(m map[string]*Pkg) []*Pkg {
+	pv := make([]*Pkg, 0, len(m))
+	for _, p := range m {
+		pv = append(pv, p)
+	}
+
+	sort.Slice(pv, func(i, j int) bool {
+		return pv[i].Name < pv[j].Name
+	})
+	return pv
+}
@@ -0,0 +1,133 @@
+// keyset.go -- KeySets from the <keyset-settings> of packages.xml
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// A set of public keys; apps use these with the KeySet APIs to
+// authorize upgrades and to recognize their peers.
+type KeySet struct {
+	ID int64
+
+	// DER encoded SubjectPublicKeyInfo of each key; these are
+	// comparable to x509.Certificate.RawSubjectPublicKeyInfo.
+	Keys [][]byte
+}
+
+// <keyset-settings>
+type xKeySetSettings struct {
+	Keys    []xPubKey `xml:"keys>public-key"`
+	KeySets []xKeySet `xml:"keysets>keyset"`
+}
+
+// base64 encoded public key
+type xPubKey struct {
+	ID    string `xml:"identifier,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type xKeySet struct {
+	ID     string   `xml:"identifier,attr"`
+	KeyIDs []xKeyID `xml:"key-id"`
+}
+
+type xKeyID struct {
+	ID string `xml:"identifier,attr"`
+}
+
+// Reference to a keyset from a <package>
+type xKeyRef struct {
+	Alias string `xml:"alias,attr,omitempty"`
+	ID    string `xml:"identifier,attr"`
+}
+
+// The keyset references of a package; these are resolved once the
+// <keyset-settings> (which follows the packages) is seen.
+type pkgKeyRefs struct {
+	p       *Pkg
+	signing string
+	defined []xKeyRef
+}
+
+// Build the keysets from <keyset-settings>
+func (x *xKeySetSettings) keySets() (map[string]*KeySet, error) {
+	keys := make(map[string][]byte, len(x.Keys))
+	for _, k := range x.Keys {
+		b, err := base64.StdEncoding.DecodeString(k.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode public key %s: %w", k.ID, err)
+		}
+		keys[k.ID] = b
+	}
+
+	ks := make(map[string]*KeySet, len(x.KeySets))
+	for _, s := range x.KeySets {
+		id, err := strconv.ParseInt(s.ID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse keyset identifier <%s>: %w", s.ID, err)
+		}
+
+		k := &KeySet{ID: id}
+		for _, kid := range s.KeyIDs {
+			b, ok := keys[kid.ID]
+			if !ok {
+				return nil, fmt.Errorf("keyset %s: Can't find public key %s", s.ID, kid.ID)
+			}
+			k.Keys = append(k.Keys, b)
+		}
+		ks[s.ID] = k
+	}
+	return ks, nil
+}
+
+// Point each package at its keysets; unknown keyset ids are ignored.
+func linkKeySets(refs []pkgKeyRefs, ks map[string]*KeySet) {
+	for _, r := range refs {
+		r.p.SigningKeySet = ks[r.signing]
+		for _, d := range r.defined {
+			k, ok := ks[d.ID]
+			if !ok {
+				continue
+			}
+			if r.p.KeySetAliases == nil {
+				r.p.KeySetAliases = make(map[string]*KeySet)
+			}
+			r.p.KeySetAliases[d.Alias] = k
+		}
+	}
+}
+
+// Return all the keysets in packages.xml sorted by id; nil if there are
+// none.
+func (db *PackageDB) KeySets() []*KeySet {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var v []*KeySet
+	for _, k := range db.keysets {
+		v = append(v, k)
+	}
+	sort.Slice(v, func(i, j int) bool {
+		return v[i].ID < v[j].ID
+	})
+	return v
+}
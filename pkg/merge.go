@@ -0,0 +1,125 @@
+// merge.go -- make one package DB out of several sources
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+)
+
+// Open the Android Package DB from several 'packages.xml' and
+// 'packages.list' readers - eg the fragments of a multi-user or
+// overlay setup - like OpenPackageDBReader(). The sources are merged
+// in order: a package in a later source replaces one of the same name
+// in an earlier source, and if their uids differ it is noted in
+// Warnings(); so does a keyset that replaces a different one with the
+// same id. Such a DB has no backing files and is never refreshed; with
+// WithStrict(false), the error joins the errors for the skipped
+// records of every source.
+func OpenPackageDBReaders(xmls, lists []io.Reader, opts ...Option) (*PackageDB, error) {
+	db := newDB(opts)
+	start := db.clock()
+
+	var warn []string
+	conflict := func(src string, p, q *Pkg) {
+		if p.Uid != q.Uid {
+			warn = append(warn, fmt.Sprintf("%s: %s has uid %d; was %d", src, q.Name, q.Uid, p.Uid))
+		}
+	}
+
+	var ll []*Pkg
+	var bad []error
+	idx := make(map[string]int)
+	for i, r := range lists {
+		fn := srcName("packages.list", i, len(lists))
+		v, b, err := parseList(r, fn, &db.cfg)
+		if err != nil {
+			return db, err
+		}
+		bad = append(bad, b...)
+
+		for _, p := range v {
+			if j, ok := idx[p.Name]; ok {
+				conflict(fn, ll[j], p)
+				ll[j] = p
+				continue
+			}
+			idx[p.Name] = len(ll)
+			ll = append(ll, p)
+		}
+	}
+
+	xx := &xmlDB{
+		shared:  make(map[uint32]string),
+		updated: make(map[string]bool),
+		renamed: make(map[string]string),
+		certs:   make(certCache),
+		keysets: make(map[string]*KeySet),
+	}
+
+	clear(idx)
+	for i, r := range xmls {
+		fn := srcName("packages.xml", i, len(xmls))
+		x, err := parseXML(r, fn, &db.cfg, xx.certs)
+		if err != nil {
+			return db, err
+		}
+
+		for _, p := range x.pkgs {
+			if j, ok := idx[p.Name]; ok {
+				conflict(fn, xx.pkgs[j], p)
+				xx.pkgs[j] = p
+				continue
+			}
+			idx[p.Name] = len(xx.pkgs)
+			xx.pkgs = append(xx.pkgs, p)
+		}
+
+		if x.hdr != (Header{}) {
+			xx.hdr = x.hdr
+		}
+		maps.Copy(xx.shared, x.shared)
+		maps.Copy(xx.updated, x.updated)
+		maps.Copy(xx.renamed, x.renamed)
+		maps.Copy(xx.certs, x.certs)
+
+		// the packages already point at their own keysets; only the
+		// ids can collide
+		for id, k := range x.keysets {
+			if o, ok := xx.keysets[id]; ok && !keySetEqual(o, k) {
+				xx.warn = append(xx.warn, fmt.Sprintf("%s: keyset %s replaces a different one from an earlier source", fn, id))
+			}
+			xx.keysets[id] = k
+		}
+		bad = append(bad, x.bad...)
+		xx.warn = append(xx.warn, x.warn...)
+		xx.certErrs = append(xx.certErrs, x.certErrs...)
+	}
+
+	xx.warn = append(xx.warn, warn...)
+	xx.took = db.clock().Sub(start)
+	db.load(xx, ll)
+	return db, errors.Join(bad...)
+}
+
+// Name the i'th of n sources of the same kind for errors and warnings
+func srcName(base string, i, n int) string {
+	if n == 1 {
+		return base
+	}
+	return fmt.Sprintf("%s[%d]", base, i)
+}
@@ -17,432 +17,2691 @@ package pkg // android/pkg
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
+	"iter"
+	"math"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrPartialDB is returned when only one of packages.xml and
+// packages.list could be read; the DB holds whatever could be parsed.
+var ErrPartialDB = errors.New("partial package DB")
+
+// ErrTooManyPackages is returned when packages.xml or packages.list
+// has more packages than allowed by WithMaxPackages().
+var ErrTooManyPackages = errors.New("too many packages")
+
+// ErrNotFound is returned by the GetXXXE() lookups when there is no
+// matching package.
+var ErrNotFound = errors.New("package not found")
+
+// ErrDBEmpty is returned by the GetXXXE() lookups when the DB isn't
+// loaded (or has been closed).
+var ErrDBEmpty = errors.New("package DB not loaded")
+
+// ErrNoUid is the error for a package in packages.xml that has
+// neither a userId nor a sharedUserId (eg some overlays). In lenient
+// mode such packages are skipped with a warning.
+var ErrNoUid = errors.New("uid and sharedUid are both Nil!")
+
+// ParseError describes where parsing packages.list or packages.xml
+// failed. Line is the line number in the file (if known) and Package
+// is the package being parsed (if known).
+type ParseError struct {
+	File    string
+	Line    int
+	Package string
+	Err     error
+}
+
+func (e *ParseError) Error() string {
+	s := e.File
+	if e.Line > 0 {
+		s += fmt.Sprintf(":%d", e.Line)
+	}
+	if len(e.Package) > 0 {
+		s += ": " + e.Package
+	}
+	return fmt.Sprintf("%s: %s", s, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Knobs that control how the DB is built
+type config struct {
+	// fail on the first malformed record
+	strict bool
+
+	// add the calling process as a pseudo package
+	self bool
+
+	// if non-nil, parsing aborts when this is done
+	ctx context.Context
+
+	// max packages per file; zero is unlimited
+	maxPkgs int
+
+	// fall back to packages-backup.xml if packages.xml is bad
+	backup bool
+
+	// parse certs on first use
+	lazyCerts bool
+
+	// splits a packages.list line into fields; nil is bytes.Fields
+	split func([]byte) [][]byte
+}
+
+// Return the reason parsing must stop, if any
+func (c *config) done() error {
+	if c.ctx == nil {
+		return nil
+	}
+	return c.ctx.Err()
+}
+
+var defaultConfig = config{
+	strict: true,
+	self:   true,
+}
+
+// Option configures a PackageDB at open time
+type Option func(c *config)
+
+// WithSelf controls whether the calling process is added to the DB as
+// a "caller-uid-N" pseudo package when not running on Android. The
+// default is true.
+func WithSelf(on bool) Option {
+	return func(c *config) {
+		c.self = on
+	}
+}
+
+// WithStrict controls whether the first malformed record fails the
+// whole parse; if false, such records are skipped as described for
+// OpenPackageDBStrict(). The default is true.
+func WithStrict(on bool) Option {
+	return func(c *config) {
+		c.strict = on
+	}
+}
+
+// WithMaxPackages limits the number of packages parsed from each of
+// packages.xml and packages.list to 'n'; files with more fail with
+// ErrTooManyPackages. Zero (the default) is unlimited.
+func WithMaxPackages(n int) Option {
+	return func(c *config) {
+		c.maxPkgs = n
+	}
+}
+
+// WithBackupFallback controls whether a packages.xml that can't be
+// read or parsed (eg it is empty because Android is in the middle of
+// writing it) is replaced by the packages-backup.xml next to it. The
+// default is false; PackageDB.XMLFile() tells which file was used.
+func WithBackupFallback(on bool) Option {
+	return func(c *config) {
+		c.backup = on
+	}
+}
+
+// WithLazyCerts defers parsing the signing certs until they are
+// needed: Cert, Certs and SigningLineage are left nil and
+// Pkg.Certificate() parses the signing cert on first use. The cert
+// hashes are still computed up front. This suits tools that only need
+// names and uids; a cert that won't parse is only noticed when it is
+// used. The default is false.
+func WithLazyCerts(on bool) Option {
+	return func(c *config) {
+		c.lazyCerts = on
+	}
+}
+
+// WithFieldSplitter sets how each line of packages.list is split into
+// fields; eg SplitTabs for the tab separated files of some OEM ROMs
+// whose paths have spaces. A line with no fields is skipped. The
+// default is bytes.Fields.
+func WithFieldSplitter(fn func(line []byte) [][]byte) Option {
+	return func(c *config) {
+		c.split = fn
+	}
+}
+
+// Split a packages.list line at each tab; blank lines have no fields.
+// For use with WithFieldSplitter.
+func SplitTabs(line []byte) [][]byte {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil
+	}
+	return bytes.Split(line, []byte("\t"))
+}
+
+// Return the fields of a packages.list line
+func (c *config) fields(line []byte) [][]byte {
+	if c.split == nil {
+		return bytes.Fields(line)
+	}
+	return c.split(line)
+}
+
+// Return true if 'n' packages exceed the limit
+func (c *config) tooMany(n int) bool {
+	return c.maxPkgs > 0 && n > c.maxPkgs
+}
+
+// Make a new DB with the default config modified by 'opts'
+func newDB(opts []Option) *PackageDB {
+	db := &PackageDB{
+		cfg: defaultConfig,
+		now: time.Now,
+	}
+	for _, o := range opts {
+		o(&db.cfg)
+	}
+	return db
+}
+
 // Exported, XML package
 type PackageDB struct {
+	// Protects the maps and lastUpd below; refresh() swaps them
+	// wholesale under the write lock.
+	mu sync.RWMutex
 
 	// Path to packages.list and packages.xml
 	list string
 	xml  string
 
+	// If set, the paths above are in this FS rather than on disk
+	fsys fs.FS
+
 	// time of last update
 	lastUpd time.Time
 
+	// the clock for lastUpd; time.Now unless a test says otherwise
+	now func() time.Time
+
+	// set if the caller disabled auto-refresh
+	noAuto bool
+
+	// set if the last refresh could only read one of the two files
+	partial bool
+
+	// how we parse the files
+	cfg config
+
+	// per-user package restrictions: user -> pkg name -> state
+	users map[int]map[string]UserState
+
+	// per-user runtime permissions
+	grants map[int]*userGrants
+
 	// lookup by package name
 	byName map[string]*Pkg
 
 	// lookup packages mapping to a UID
 	byUid map[uint32][]*Pkg
+
+	// lookup packages by their installer
+	byInstaller map[string][]*Pkg
+
+	// lookup by code path
+	byPath map[string]*Pkg
+
+	// lookup by hex encoded SHA1 and SHA256 cert hash
+	byCertHash    map[string][]*Pkg
+	byCertHash256 map[string][]*Pkg
+
+	// lookup by SELinux seinfo tag
+	bySEinfo map[string][]*Pkg
+
+	// lookup by granted permission
+	byPerm map[string][]*Pkg
+
+	// lookup by supplementary gid
+	byGid map[uint32][]*Pkg
+
+	// packages.xml header
+	hdr Header
+
+	// declared shared uids: uid -> name (eg android.uid.system)
+	shared map[uint32]string
+
+	// system packages with an <updated-package> entry
+	updated map[string]bool
+
+	// renamed packages: new name -> original name
+	renamed map[string]string
+
+	// non-fatal oddities seen during the last refresh
+	warn []string
+
+	// parsed certs from the last refresh; reused by the next one
+	certs certCache
+
+	// packages.xml used by the last refresh
+	xmlUsed string
+
+	// keysets from <keyset-settings>: id -> keyset
+	keysets map[string]*KeySet
+
+	// uids in only one of packages.xml and packages.list
+	orphans []uint32
+
+	// counters from the last refresh
+	stats Stats
+
+	// the pseudo package added by WithSelf
+	self *Pkg
+
+	// called after each refresh; see OnRefresh()
+	hooks []func(db *PackageDB)
+
+	// non-zero while the hooks run
+	inHooks atomic.Int32
+}
+
+// Header of packages.xml: the build that last wrote it
+type Header struct {
+	SdkVersion      int    `json:"sdk_version"`
+	DatabaseVersion int    `json:"database_version"`
+	Fingerprint     string `json:"fingerprint"`
+	VolumeUuid      string `json:"volume_uuid,omitempty"`
 }
 
+// Values of Pkg.InstallReason; these mirror the
+// PackageManager.INSTALL_REASON_* values.
+const (
+	InstallReasonUnknown       = 0
+	InstallReasonPolicy        = 1
+	InstallReasonDeviceRestore = 2
+	InstallReasonDeviceSetup   = 3
+	InstallReasonUser          = 4
+	InstallReasonRollback      = 5
+)
+
+// Return the name of the install reason 'r' (eg "device-setup");
+// reasons we don't know about are "unknown".
+func InstallReasonName(r int) string {
+	switch r {
+	case InstallReasonPolicy:
+		return "policy"
+	case InstallReasonDeviceRestore:
+		return "device-restore"
+	case InstallReasonDeviceSetup:
+		return "device-setup"
+	case InstallReasonUser:
+		return "user"
+	case InstallReasonRollback:
+		return "rollback"
+	default:
+		return "unknown"
+	}
+}
+
+// Bits in Pkg.Flags; these mirror the ApplicationInfo.FLAG_* values
+// Android writes to the publicFlags attribute.
+const (
+	FlagSystem           uint32 = 1 << 0
+	FlagDebuggable       uint32 = 1 << 1
+	FlagHasCode          uint32 = 1 << 2
+	FlagUpdatedSystemApp uint32 = 1 << 7
+)
+
 // Common struct for packages.xml and packages.list
 // Some fields are unique to one but not the other
 type Pkg struct {
 	Name     string
 	DataPath string // only in .list
 	Path     string
-	Uid      uint32
-
-	// The next two fields are for packages.list
-	SEinfo string
-	Gid    []uint32
+	Uid      uint32 // effective uid
+
+	// The sharedUserId of the package; zero if it has its own uid.
+	// Only in .xml
+	SharedUid uint32
+
+	// Where the app's native libraries live - only in .xml
+	NativeLibraryPath string
+
+	// Names of the split APKs installed with the base APK (eg
+	// config.arm64_v8a); see AllApkPaths(). Only in .xml
+	Splits []string
+
+	// The ABIs the app's native code runs as and the ABI forced by
+	// the installer (if any); empty for apps without native code.
+	// Only in .xml
+	PrimaryCpuAbi   string
+	SecondaryCpuAbi string
+	CpuAbiOverride  string
+
+	// The storage volume the app is installed on; VolumeInternal or
+	// VolumePrimaryPhysical or the uuid of an adopted volume. Only in
+	// .xml
+	VolumeUuid string
+
+	// The next four fields are for packages.list
+	SEinfo     string
+	SEinfoUser string // only in newer releases
+	Gid        []uint32
+	Debug      bool
+
+	// Version name and version code; older packages.xml files only
+	// carry the numeric code. Only in .xml
+	Version     string
+	VersionCode int64
+
+	// ApplicationInfo flags (FLAG_xxx above) - only in .xml
+	Flags uint32
+
+	// Whether the app is enabled and the components whose state was
+	// overridden (by class name); the parsers set Enabled for every
+	// package that isn't disabled. Only in .xml
+	Enabled            bool
+	DisabledComponents []string
+	EnabledComponents  []string
+
+	// Permissions granted to the app; nil if packages.xml doesn't
+	// record them (newer releases keep them in runtime-permissions.xml).
+	// Only in .xml
+	Permissions []string
+
+	// Install and last update time; zero if unknown. Only in .xml
+	FirstInstallTime time.Time
+	LastUpdateTime   time.Time
+
+	// Package name of the installer (eg com.android.vending);
+	// empty if unknown. Only in .xml
+	Installer string
+
+	// The packages that asked the installer to install this one and
+	// that the install originated from (eg a browser); empty if
+	// unknown. Android 11 and later; only in .xml
+	InitiatingInstaller  string
+	OriginatingInstaller string
+
+	// Why the package was installed (InstallReasonXXX) and whether
+	// its installer has since been uninstalled. Only in .xml
+	InstallReason int
+	IsOrphaned    bool
 
 	// If one exists - also only in .xml
 	Cert *x509.Certificate
 
+	// DER encoding of the signing cert exactly as in packages.xml;
+	// set even if Cert isn't (see WithLazyCerts)
+	CertDER []byte
+
 	// SHA1 hash of the DER encoding of certificate
 	Certhash []byte
+
+	// SHA256 hash of the DER encoding of certificate
+	Certhash256 []byte
+
+	// All the certs (and their SHA1 hashes) for packages with more
+	// than one signer; Cert and Certhash above are the first of these.
+	Certs      []*x509.Certificate
+	CertHashes [][]byte
+
+	// The signing certs of the package oldest to newest, for packages
+	// that rotated their signing key (APK signature scheme v3). Else,
+	// the same as Certs. Android keeps the lineage in the <pastSigs>
+	// under the package's <sigs>; packages.xml has no separate
+	// signing details element. Only in .xml
+	SigningLineage []*x509.Certificate
+
+	// The number of signers and the APK signature schemes they were
+	// verified with (eg "v3"); the schemes are only known on Android
+	// P and later. Only in .xml
+	SignerCount      int
+	SignatureSchemes []string
+
+	// The KeySet that signed the package and the KeySets it defined
+	// by alias; nil if packages.xml has no <keyset-settings>. Only in
+	// .xml
+	SigningKeySet *KeySet
+	KeySetAliases map[string]*KeySet
+
+	// The DB this package belongs to; used for the per-user state
+	db *PackageDB
+
+	// The enabled state as parsed (EnabledStateXXX); Enabled can't
+	// tell the kinds of disabled apart
+	enabled int
+
+	// true for the calling process added by WithSelf
+	pseudo bool
+
+	// the certs and signing lineage as parsed; possibly not decoded
+	certs   []*lazyCert
+	lineage []*lazyCert
+}
+
+// Return true if this is a system app
+func (p *Pkg) IsSystemApp() bool {
+	return p.Flags&FlagSystem > 0
+}
+
+// Return true if this app is debuggable
+func (p *Pkg) IsDebuggable() bool {
+	return p.Flags&FlagDebuggable > 0
+}
+
+// Return true if this is a system app that has been updated: either
+// its flags say so or packages.xml has an <updated-package> for it.
+func (p *Pkg) IsUpdatedSystemApp() bool {
+	if p.Flags&FlagUpdatedSystemApp > 0 {
+		return true
+	}
+	if p.db == nil {
+		return false
+	}
+
+	p.db.mu.RLock()
+	defer p.db.mu.RUnlock()
+
+	return p.db.updated[p.Name]
+}
+
+// Return true if this app runs under a shared uid
+func (p *Pkg) IsShared() bool {
+	return p.SharedUid != 0
+}
+
+// Return true if this app has code
+func (p *Pkg) HasCode() bool {
+	return p.Flags&FlagHasCode > 0
+}
+
+// Partitions that hold the apps shipped with the device
+var preinstalledDirs = []string{"/system", "/system_ext", "/product", "/vendor", "/odm"}
+
+// Return true if the app's code path is in the priv-app directory of
+// one of the device partitions (eg /system/priv-app). Unlike the flag
+// based predicates, this works even if packages.xml has no flags.
+func (p *Pkg) IsPrivileged() bool {
+	for _, d := range preinstalledDirs {
+		if inDir(p.Path, d+"/priv-app") {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the app's code path is on one of the device
+// partitions (/system, /vendor, /product etc) rather than /data.
+func (p *Pkg) IsPreinstalled() bool {
+	for _, d := range preinstalledDirs {
+		if inDir(p.Path, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if 'fn' is 'dir' or is below it
+func inDir(fn, dir string) bool {
+	fn = path.Clean(fn)
+	return fn == dir || strings.HasPrefix(fn, dir+"/")
+}
+
+// Return the paths of the base APK and every split APK of the package;
+// nil if the code path isn't known. In the old layout the code path is
+// the APK itself; in the new layout it is the directory holding
+// base.apk and split_<name>.apk.
+func (p *Pkg) AllApkPaths() []string {
+	if len(p.Path) == 0 {
+		return nil
+	}
+
+	dir, base := p.Path, path.Join(p.Path, "base.apk")
+	if strings.HasSuffix(p.Path, ".apk") {
+		dir, base = path.Dir(p.Path), p.Path
+	}
+
+	v := make([]string, 0, 1+len(p.Splits))
+	v = append(v, base)
+	for _, nm := range p.Splits {
+		switch {
+		case path.IsAbs(nm):
+			v = append(v, nm)
+		case strings.HasSuffix(nm, ".apk"):
+			v = append(v, path.Join(dir, nm))
+		default:
+			v = append(v, path.Join(dir, "split_"+nm+".apk"))
+		}
+	}
+	return v
+}
+
+// Return the native ABI (arm64, armeabi-v7a, x86_64 etc) inferred from
+// a native library path of the form .../lib/<abi>; empty otherwise.
+func (p *Pkg) NativeABI() string {
+	if len(p.NativeLibraryPath) == 0 {
+		return ""
+	}
+
+	dir, abi := path.Split(path.Clean(p.NativeLibraryPath))
+	if path.Base(dir) != "lib" {
+		return ""
+	}
+	return abi
+}
+
+func (p *Pkg) String() string {
+	crt := ""
+
+	if c := p.cert(); c != nil {
+		crt = fmt.Sprintf(" [SN/%s: hash/%x]", c.Subject.CommonName, p.Certhash)
+	}
+	return fmt.Sprintf("%s: %v%s", p.Name, p.Uid, crt)
+}
+
+// Open the Android Package DB represented by two files
+// 'packages.xml' and 'packages.list' -- respectively 'xml', 'list'
+// input args
+func OpenPackageDB(xml, list string, opts ...Option) (*PackageDB, error) {
+	return OpenPackageDBStrict(xml, list, true, opts...)
+}
+
+// Open the Android Package DB like OpenPackageDB(). If 'strict' is
+// false, malformed lines in packages.list and malformed packages in
+// packages.xml are skipped rather than failing the whole parse; the
+// DB holds every package that parsed cleanly and the returned error
+// joins the errors for the skipped records. Packages whose certs can't
+// be decoded are kept without certs and reported by Stats() instead;
+// packages without a uid are skipped and reported by Warnings().
+// 'strict' is the same as a leading WithStrict(strict); a WithStrict
+// in 'opts' overrides it.
+func OpenPackageDBStrict(xml, list string, strict bool, opts ...Option) (*PackageDB, error) {
+	db := newDB(append([]Option{WithStrict(strict)}, opts...))
+	db.list = list
+	db.xml = xml
+
+	err := db.refresh()
+	return db, err
+}
+
+// Open the Android Package DB like OpenPackageDB() but abort reading
+// and parsing the files with ctx.Err() if 'ctx' is done before then.
+// The context only bounds the initial parse; later refreshes ignore it.
+func OpenPackageDBContext(ctx context.Context, xml, list string, opts ...Option) (*PackageDB, error) {
+	db := newDB(opts)
+	db.list = list
+	db.xml = xml
+	db.cfg.ctx = ctx
+
+	err := db.refresh()
+	db.cfg.ctx = nil
+	if cerr := ctx.Err(); cerr != nil {
+		return nil, cerr
+	}
+	return db, err
+}
+
+// Open the Android Package DB from 'packages.xml' and 'packages.list'
+// in the file system 'fsys'; the paths follow fs.FS conventions (no
+// leading slash). The DB is refreshed only if fsys implements
+// fs.StatFS.
+func OpenPackageDBFS(fsys fs.FS, xml, list string, opts ...Option) (*PackageDB, error) {
+	db := newDB(opts)
+	db.list = list
+	db.xml = xml
+	db.fsys = fsys
+
+	err := db.refresh()
+	return db, err
+}
+
+// Open the Android Package DB from packages.xml and packages.list in
+// the directory 'dir' (usually /data/system). A packages.xml that is
+// missing or bad is replaced by the packages-backup.xml in 'dir'
+// unless WithBackupFallback(false) is given. The paths are made
+// absolute so that refreshes don't depend on the current directory.
+func OpenPackageDBDir(dir string, opts ...Option) (*PackageDB, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: errors.New("not a directory")}
+	}
+
+	db := newDB(append([]Option{WithBackupFallback(true)}, opts...))
+	db.list = filepath.Join(dir, "packages.list")
+	db.xml = filepath.Join(dir, "packages.xml")
+
+	err = db.refresh()
+	return db, err
+}
+
+// Open the Android Package DB from the contents of 'packages.xml' and
+// 'packages.list' supplied as readers. Such a DB has no backing files
+// and is never refreshed. With WithStrict(false), the error joins the
+// errors for the skipped records just like OpenPackageDBStrict().
+func OpenPackageDBReader(xml, list io.Reader, opts ...Option) (*PackageDB, error) {
+	db := newDB(opts)
+	start := db.clock()
+
+	ll, bad, err := parseList(list, "packages.list", &db.cfg)
+	if err != nil {
+		return db, err
+	}
+
+	xx, err := parseXML(xml, "packages.xml", &db.cfg, nil)
+	if err != nil {
+		return db, err
+	}
+
+	xx.took = db.clock().Sub(start)
+	db.load(xx, ll)
+
+	// the records skipped in lenient mode
+	bad = append(bad, xx.bad...)
+	return db, errors.Join(bad...)
+}
+
+// Make a DB out of 'pkgs' without reading any files; this is mostly
+// useful for tests. The DB is never refreshed and takes ownership of
+// the Pkg values; later duplicates of a name replace earlier ones.
+// Note that the zero Pkg is disabled: set Enabled for packages that
+// WriteXML() shouldn't write as disabled.
+func NewPackageDB(pkgs []*Pkg) *PackageDB {
+	db := newDB(nil)
+	db.noAuto = true
+
+	byName := make(map[string]*Pkg, len(pkgs))
+	for _, p := range pkgs {
+		byName[p.Name] = p
+	}
+
+	db.install(byName, &xmlDB{shared: make(map[uint32]string)})
+	return db
+}
+
+// XXX What to implement here?
+func (db *PackageDB) Close() {
+	db.mu.Lock()
+	db.byName = nil
+	db.byUid = nil
+	db.byInstaller = nil
+	db.byPath = nil
+	db.byCertHash = nil
+	db.byCertHash256 = nil
+	db.bySEinfo = nil
+	db.byPerm = nil
+	db.byGid = nil
+	db.certs = nil
+	db.self = nil
+	db.mu.Unlock()
+}
+
+// Given an UID, return the list of packages that use it
+func (db *PackageDB) GetListByUid(uid uint32) []*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if r, ok := db.byUid[uid]; ok {
+		return r
+	}
+
+	return nil
+}
+
+// Return the sorted data directories of all the packages that use
+// 'uid'; packages without one (those only in packages.xml) are
+// skipped.
+func (db *PackageDB) DataPathsForUid(uid uint32) []string {
+	var v []string
+	for _, p := range db.GetListByUid(uid) {
+		if len(p.DataPath) > 0 {
+			v = append(v, p.DataPath)
+		}
+	}
+
+	sort.Strings(v)
+	return slices.Compact(v)
+}
+
+// Return all packages with lo <= uid <= hi sorted by uid and then by
+// name
+func (db *PackageDB) GetByUidRange(lo, hi uint32) []*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var uids []uint32
+	for uid := range db.byUid {
+		if uid >= lo && uid <= hi {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] < uids[j]
+	})
+
+	var pv []*Pkg
+	for _, uid := range uids {
+		// each slice is already sorted by name
+		pv = append(pv, db.byUid[uid]...)
+	}
+	return pv
+}
+
+func (db *PackageDB) GetByName(nm string) *Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if r, ok := db.byName[nm]; ok {
+		return r
+	}
+	return nil
+}
+
+// Look up all of 'names' at once; the result maps each name to its
+// package and leaves out the names that aren't in the DB. This is
+// cheaper than calling GetByName() for each name.
+func (db *PackageDB) GetByNameBatch(names []string) map[string]*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	m := make(map[string]*Pkg, len(names))
+	for _, nm := range names {
+		if p, ok := db.byName[nm]; ok {
+			m[nm] = p
+		}
+	}
+	return m
+}
+
+// Like GetByName() but return an error wrapping ErrNotFound if there
+// is no such package and ErrDBEmpty if the DB isn't loaded.
+func (db *PackageDB) GetByNameE(nm string) (*Pkg, error) {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.byName == nil {
+		return nil, ErrDBEmpty
+	}
+	if r, ok := db.byName[nm]; ok {
+		return r, nil
+	}
+	return nil, fmt.Errorf("%s: %w", nm, ErrNotFound)
+}
+
+// Given an installer package name, return the list of packages it
+// installed
+func (db *PackageDB) GetByInstaller(nm string) []*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if r, ok := db.byInstaller[nm]; ok {
+		return r
+	}
+	return nil
+}
+
+// Group packages by installer package name; sideloaded packages and
+// those whose installer isn't known are under "". Each group is sorted
+// by name.
+func (db *PackageDB) GroupByInstaller() map[string][]*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	m := make(map[string][]*Pkg)
+	for _, p := range sortedPkgs(db.byName) {
+		if !p.pseudo {
+			m[p.Installer] = append(m[p.Installer], p)
+		}
+	}
+	return m
 }
 
-func (p *Pkg) String() string {
-	crt := ""
+// Given the code path of a package or the path of an apk inside it,
+// return the package. Both the old layout (codePath is the apk
+// itself: /data/app/com.foo-1.apk) and the new layout (codePath is a
+// directory: /data/app/com.foo-1/base.apk) are handled.
+func (db *PackageDB) GetByCodePath(nm string) *Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	nm = path.Clean(nm)
+	if r, ok := db.byPath[nm]; ok {
+		return r
+	}
+
+	if strings.HasSuffix(nm, ".apk") {
+		if r, ok := db.byPath[path.Dir(nm)]; ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// Given the SHA1 hash of a signing cert, return the list of packages
+// signed by it
+func (db *PackageDB) GetByCertHash(h []byte) []*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if r, ok := db.byCertHash[hex.EncodeToString(h)]; ok {
+		return r
+	}
+	return nil
+}
+
+// Given the SHA256 hash of a signing cert, return the list of packages
+// signed by it
+func (db *PackageDB) GetByCertHash256(h []byte) []*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if r, ok := db.byCertHash256[hex.EncodeToString(h)]; ok {
+		return r
+	}
+	return nil
+}
+
+// Return the non-fatal problems seen when the DB was last refreshed,
+// eg duplicate entries in packages.list, elements in packages.xml
+// that this package doesn't know about (usually a sign of a newer
+// Android release) or, in lenient mode, packages without a uid.
+func (db *PackageDB) Warnings() []string {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return slices.Clone(db.warn)
+}
+
+// Return the name that the package now called 'nm' had before it was
+// renamed; 'nm' itself if it wasn't renamed.
+func (db *PackageDB) OriginalName(nm string) string {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if old, ok := db.renamed[nm]; ok {
+		return old
+	}
+	return nm
+}
+
+// Given a permission name (eg "android.permission.INTERNET"), return
+// the list of packages that were granted it
+func (db *PackageDB) GetByPermission(nm string) []*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if r, ok := db.byPerm[nm]; ok {
+		return r
+	}
+	return nil
+}
+
+// Given a seinfo tag (eg "platform" or "default:privapp"), return the
+// list of packages labeled with it
+func (db *PackageDB) GetBySEinfo(se string) []*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if r, ok := db.bySEinfo[se]; ok {
+		return r
+	}
+	return nil
+}
+
+// Return the name of the shared user (eg android.uid.system) declared
+// for 'uid'; empty if uid isn't a declared shared uid
+func (db *PackageDB) GetSharedUserName(uid uint32) string {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.shared[uid]
+}
+
+// Return the sorted names of all declared shared users
+func (db *PackageDB) ListSharedUsers() []string {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	v := make([]string, 0, len(db.shared))
+	for _, nm := range db.shared {
+		v = append(v, nm)
+	}
+	sort.Strings(v)
+	return v
+}
+
+// Return the number of distinct packages in the DB
+func (db *PackageDB) Len() int {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return len(db.byName)
+}
+
+// Return the sorted uids that have packages in only one of
+// packages.xml and packages.list; this happens briefly while Android
+// installs or removes apps. DBs missing either file have none.
+func (db *PackageDB) OrphanedUids() []uint32 {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return slices.Clone(db.orphans)
+}
+
+// Return every uid that isn't a shared uid (see <shared-user>) yet has
+// more than one package, and its packages sorted by name. Such uids
+// are a sign of tampering or a parse bug.
+func (db *PackageDB) DuplicateUids() map[uint32][]*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	m := make(map[uint32][]*Pkg)
+	for uid, pv := range db.byUid {
+		if _, ok := db.shared[uid]; ok {
+			continue
+		}
+
+		pv = slices.DeleteFunc(slices.Clone(pv), func(p *Pkg) bool {
+			return p.pseudo
+		})
+		if len(pv) > 1 {
+			sort.Slice(pv, func(i, j int) bool {
+				return pv[i].Name < pv[j].Name
+			})
+			m[uid] = pv
+		}
+	}
+	return m
+}
+
+// Return the packages.xml file the DB was last loaded from: either the
+// one it was opened with or its packages-backup.xml (see
+// WithBackupFallback). Empty if the DB has no backing files.
+func (db *PackageDB) XMLFile() string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.xmlUsed
+}
+
+// Summarize the DB as of the last refresh
+func (db *PackageDB) String() string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return fmt.Sprintf("PackageDB: %d packages, %d uids, %d shared uids; sdk %d, db version %d",
+		len(db.byName), len(db.byUid), len(db.shared), db.hdr.SdkVersion, db.hdr.DatabaseVersion)
+}
+
+// Write every package to 'w' - one per line, sorted by name
+func (db *PackageDB) Dump(w io.Writer) error {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	pv := sortedPkgs(db.byName)
+	db.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, p := range pv {
+		bw.WriteString(p.String())
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// Return the sorted list of package names
+func (db *PackageDB) Names() []string {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	v := make([]string, 0, len(db.byName))
+	for nm := range db.byName {
+		v = append(v, nm)
+	}
+	sort.Strings(v)
+	return v
+}
+
+// Return the sorted list of distinct uids
+func (db *PackageDB) Uids() []uint32 {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	v := make([]uint32, 0, len(db.byUid))
+	for u := range db.byUid {
+		v = append(v, u)
+	}
+	sort.Slice(v, func(i, j int) bool {
+		return v[i] < v[j]
+	})
+	return v
+}
+
+// Return the header of packages.xml; it is the zero value if the file
+// had no <version> element.
+func (db *PackageDB) Header() Header {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.hdr
+}
+
+func (db *PackageDB) LastUpdate() time.Time {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.lastUpd
+}
+
+// Given a Package UID, return the first matching uid
+func (db *PackageDB) GetByUid(uid uint32) *Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if r, ok := db.byUid[uid]; ok {
+		return r[0]
+	}
+	return nil
+}
+
+// Given a supplementary gid, return the list of packages that have it
+func (db *PackageDB) GetByGid(gid uint32) []*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if r, ok := db.byGid[gid]; ok {
+		return r
+	}
+	return nil
+}
+
+// Like GetByUid() but return an error wrapping ErrNotFound if there is
+// no such package and ErrDBEmpty if the DB isn't loaded.
+func (db *PackageDB) GetByUidE(uid uint32) (*Pkg, error) {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.byUid == nil {
+		return nil, ErrDBEmpty
+	}
+	if r, ok := db.byUid[uid]; ok {
+		return r[0], nil
+	}
+	return nil, fmt.Errorf("uid %d: %w", uid, ErrNotFound)
+}
+
+// Start an iterator - based on Name
+// Creates and returns a channel and feeds it data via a go routine
+//
+// The iterator walks the maps current at the time of the call;
+// a concurrent refresh doesn't affect it.
+//
+// The caller must drain the channel; a caller that may stop early
+// should use IterateByNameContext() instead.
+func (db *PackageDB) IterateByName() chan *Pkg {
+	return db.IterateByNameContext(context.Background())
+}
+
+// Start an iterator - based on Name - that can be abandoned early.
+// The caller must either drain the channel or cancel ctx; when ctx
+// is cancelled the feeding go routine closes the channel and exits.
+func (db *PackageDB) IterateByNameContext(ctx context.Context) chan *Pkg {
+	ch := make(chan *Pkg, 1)
+
+	db.mu.RLock()
+	byName := db.byName
+	db.mu.RUnlock()
+
+	go func(m map[string]*Pkg, ch chan *Pkg) {
+		defer close(ch)
+		for _, p := range m {
+			select {
+			case ch <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(byName, ch)
+
+	return ch
+}
+
+// Start an iterator like IterateByName() that yields the packages in
+// ascending order of name. This costs a sort of the packages up front.
+func (db *PackageDB) IterateByNameSorted() chan *Pkg {
+	return db.IterateByNameSortedContext(context.Background())
+}
+
+// Start a sorted iterator that can be abandoned early; see
+// IterateByNameContext().
+func (db *PackageDB) IterateByNameSortedContext(ctx context.Context) chan *Pkg {
+	ch := make(chan *Pkg, 1)
+
+	db.mu.RLock()
+	pv := sortedPkgs(db.byName)
+	db.mu.RUnlock()
+
+	go func(pv []*Pkg, ch chan *Pkg) {
+		defer close(ch)
+		for _, p := range pv {
+			select {
+			case ch <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(pv, ch)
+
+	return ch
+}
+
+// Start an iterator - based on Uid
+// Creates and returns a channel and feeds it data via a go routine
+//
+// The caller must drain the channel; a caller that may stop early
+// should use IterateByUidContext() instead.
+func (db *PackageDB) IterateByUid() chan []*Pkg {
+	return db.IterateByUidContext(context.Background())
+}
+
+// Start an iterator - based on Uid - that can be abandoned early.
+// The caller must either drain the channel or cancel ctx.
+func (db *PackageDB) IterateByUidContext(ctx context.Context) chan []*Pkg {
+	ch := make(chan []*Pkg, 1)
+
+	db.mu.RLock()
+	byUid := db.byUid
+	db.mu.RUnlock()
+
+	go func(m map[uint32][]*Pkg, ch chan []*Pkg) {
+		defer close(ch)
+		for _, p := range m {
+			select {
+			case ch <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(byUid, ch)
+
+	return ch
+}
+
+// Re-read the backing files and update the in-core data. This is a
+// no-op for a DB that has no backing files.
+func (db *PackageDB) Refresh() error {
+	if !db.hasFiles() {
+		return nil
+	}
+	return db.refresh()
+}
+
+// Enable or disable the implicit refresh done by the lookup methods.
+// With auto-refresh off, the DB is a stable snapshot until the next
+// call to Refresh(). Auto-refresh is on by default.
+func (db *PackageDB) SetAutoRefresh(on bool) {
+	db.mu.Lock()
+	db.noAuto = !on
+	db.mu.Unlock()
+}
+
+// Return true if the DB is backed by files
+func (db *PackageDB) hasFiles() bool {
+	return len(db.list) > 0 || len(db.xml) > 0
+}
+
+// Open a backing file - either on disk or in the DB's fs.FS
+func (db *PackageDB) open(fn string) (fs.File, error) {
+	if db.fsys != nil {
+		return db.fsys.Open(fn)
+	}
+	return os.Open(fn)
+}
+
+// Stat a backing file; an fs.FS that can't stat makes the DB static.
+func (db *PackageDB) stat(fn string) (fs.FileInfo, error) {
+	if db.fsys != nil {
+		if sfs, ok := db.fsys.(fs.StatFS); ok {
+			return sfs.Stat(fn)
+		}
+		return nil, errors.ErrUnsupported
+	}
+	return os.Stat(fn)
+}
+
+// Return an iterator over all packages, for use with range:
+//
+//	for p := range db.Packages() { ... }
+//
+// The iteration sees the maps current at the time of the call, so the
+// loop body can break early or call other methods on the DB without
+// leaking or deadlocking.
+func (db *PackageDB) Packages() iter.Seq[*Pkg] {
+	db.mu.RLock()
+	byName := db.byName
+	db.mu.RUnlock()
+
+	return func(yield func(*Pkg) bool) {
+		for _, p := range byName {
+			if !yield(p) {
+				return
+			}
+		}
+	}
+}
+
+// Return an iterator over uids and the packages that use them
+func (db *PackageDB) PackagesByUid() iter.Seq2[uint32, []*Pkg] {
+	db.mu.RLock()
+	byUid := db.byUid
+	db.mu.RUnlock()
+
+	return func(yield func(uint32, []*Pkg) bool) {
+		for u, pv := range byUid {
+			if !yield(u, pv) {
+				return
+			}
+		}
+	}
+}
+
+// If the packages.{list,xml} is newer than what we have, update our
+// in-core data.
+func (db *PackageDB) maybeRefresh() {
+	// DBs made from readers have nothing to go back to
+	if !db.hasFiles() {
+		return
+	}
+
+	db.mu.RLock()
+	noAuto := db.noAuto
+	db.mu.RUnlock()
+
+	// a hook that uses the DB mustn't trigger another refresh (and
+	// call itself)
+	if noAuto || db.inHooks.Load() > 0 {
+		return
+	}
+
+	if db.stale() {
+		db.refresh()
+	}
+}
+
+// Return true if the backing files have changed since we last read
+// them.
+func (db *PackageDB) stale() bool {
+	// A partial DB only has one of the two files to go on
+	st0, err0 := db.stat(db.list)
+	st1, err1 := db.stat(db.xml)
+	if err0 != nil && err1 != nil {
+		return false
+	}
+
+	db.mu.RLock()
+	last := db.lastUpd
+	partial := db.partial
+	db.mu.RUnlock()
+
+	// the missing file showed up
+	if partial && err0 == nil && err1 == nil {
+		return true
+	}
+
+	return (err0 == nil && st0.ModTime().After(last)) || (err1 == nil && st1.ModTime().After(last))
+}
+
+// Read and update the package DB. If only one of the two files can be
+// read, the DB is populated from it and the returned error wraps both
+// ErrPartialDB and the error for the unreadable file.
+//
+// The new data replaces the old in one step and only if both files
+// parsed; on any error a DB that was completely loaded keeps its
+// previous data. A file that is unreadable or truncated is most likely
+// being rewritten by Android and the next refresh will pick it up.
+func (db *PackageDB) refresh() error {
+	var ll []*Pkg
+	var bad []error
+	var lerr, xerr error
+	var xx *xmlDB
+
+	ctx := db.cfg.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// The two files are independent; parse them concurrently and let
+	// the first fatal error cancel the other parse.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cfg := db.cfg
+	cfg.ctx = ctx
+
+	start := db.clock()
+	g := &group{cancel: cancel}
+	g.Go(func() error {
+		ll, bad, lerr = db.parseListFile(&cfg)
+		return fatal(lerr)
+	})
+	g.Go(func() error {
+		xx, xerr = db.parseXMLFile(&cfg)
+		return fatal(xerr)
+	})
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	var err error
+	switch {
+	case lerr != nil && xerr != nil:
+		return lerr
+
+	case db.complete() && lerr != nil:
+		return lerr
+
+	case db.complete() && xerr != nil:
+		return xerr
+
+	case lerr != nil:
+		err = fmt.Errorf("%w: %w", ErrPartialDB, lerr)
+
+	case xerr != nil:
+		xx = &xmlDB{shared: make(map[uint32]string)}
+		err = fmt.Errorf("%w: %w", ErrPartialDB, xerr)
+	}
+
+	xx.partial = err != nil
+	xx.took = db.clock().Sub(start)
+	db.load(xx, ll)
+	db.runHooks()
+
+	// Finally, the records skipped in lenient mode
+	bad = append(bad, xx.bad...)
+	if len(bad) > 0 {
+		return errors.Join(append([]error{err}, bad...)...)
+	}
+	return err
+}
+
+// Register 'fn' to be called after every refresh that replaces the
+// data in the DB - explicit or automatic; a refresh that fails and
+// keeps the old data doesn't count. The callbacks are called in the
+// order they were registered, without any of the DB locks held; the
+// DB isn't refreshed automatically while they run.
+func (db *PackageDB) OnRefresh(fn func(db *PackageDB)) {
+	db.mu.Lock()
+	db.hooks = append(db.hooks, fn)
+	db.mu.Unlock()
+}
+
+// Call the OnRefresh() callbacks
+func (db *PackageDB) runHooks() {
+	db.mu.RLock()
+	hooks := db.hooks
+	db.mu.RUnlock()
+
+	db.inHooks.Add(1)
+	defer db.inHooks.Add(-1)
+
+	for _, fn := range hooks {
+		fn(db)
+	}
+}
+
+// Return the current time per the DB's clock
+func (db *PackageDB) clock() time.Time {
+	if db.now == nil {
+		return time.Now()
+	}
+	return db.now()
+}
+
+// Return true if the DB holds data from both files
+func (db *PackageDB) complete() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.byName != nil && !db.partial
+}
+
+// Return err unless it is an unreadable file
+func fatal(err error) error {
+	if err != nil && isUnreadable(err) {
+		return nil
+	}
+	return err
+}
+
+// A group of go routines where the first error cancels the rest
+type group struct {
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+	cancel func()
+}
+
+// Run fn in a new go routine
+func (g *group) Go(fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := fn(); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+// Wait for all go routines to finish and return the first error
+func (g *group) Wait() error {
+	g.wg.Wait()
+	return g.err
+}
+
+// Return true if err is a failure to open or read a file (as opposed
+// to a failure to parse its contents)
+func isUnreadable(err error) bool {
+	var pe *fs.PathError
+	return errors.As(err, &pe)
+}
+
+// Build fresh lookup tables from the parsed xml and list records and
+// swap them in.
+func (db *PackageDB) load(xx *xmlDB, ll []*Pkg) {
+	// We always make new maps and discard the previous ones.
+	// This is the only clean way to guarantee that when apps are
+	// deleted, our data is valid.
+	byName := make(map[string]*Pkg)
+
+	// Start with canonical representation from packages.xml
+	for _, p := range xx.pkgs {
+		byName[p.Name] = p
+	}
+
+	// And merge data from packages.list into it; the last of any
+	// duplicate lines wins.
+	seen := make(map[string]bool, len(ll))
+	for _, p := range ll {
+		if seen[p.Name] {
+			xx.warn = append(xx.warn, fmt.Sprintf("%s: duplicate entry for %s", db.listName(), p.Name))
+		}
+		seen[p.Name] = true
+
+		if a, ok := byName[p.Name]; ok {
+			a.Gid = p.Gid
+			a.DataPath = p.DataPath
+			a.Debug = p.Debug
+			a.SEinfo = p.SEinfo
+			a.SEinfoUser = p.SEinfoUser
+		} else {
+			byName[p.Name] = p
+		}
+	}
+
+	xx.orphans = orphans(xx.pkgs, ll)
+
+	// Finally, if we are NOT on Android, add the calling process to
+	// the DB for debugging purposes
+	if db.cfg.self {
+		if p := getself(); p != nil {
+			p.pseudo = true
+			byName[p.Name] = p
+		}
+	}
+
+	db.install(byName, xx)
+}
+
+// Return the package of the calling process. On Android, this is the
+// package that runs as the process' uid; elsewhere it is the pseudo
+// package added by WithSelf() (nil if that is turned off).
+func (db *PackageDB) Self() *Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	self := db.self
+	db.mu.RUnlock()
+
+	if self != nil {
+		return self
+	}
+
+	// getself() only has a package to offer off device
+	if getself() != nil {
+		return nil
+	}
+	return db.GetByUid(uint32(os.Getuid()))
+}
+
+// Return the sorted uids that appear in only one of packages.xml and
+// packages.list; nil if either is empty.
+func orphans(xp, lp []*Pkg) []uint32 {
+	if len(xp) == 0 || len(lp) == 0 {
+		return nil
+	}
+
+	uids := func(pv []*Pkg) map[uint32]bool {
+		m := make(map[uint32]bool, len(pv))
+		for _, p := range pv {
+			m[p.Uid] = true
+		}
+		return m
+	}
+
+	xu := uids(xp)
+	lu := uids(lp)
+
+	var r []uint32
+	for u := range xu {
+		if !lu[u] {
+			r = append(r, u)
+		}
+	}
+	for u := range lu {
+		if !xu[u] {
+			r = append(r, u)
+		}
+	}
+	slices.Sort(r)
+	return r
+}
+
+// Build the reverse lookup tables for the packages in 'byName' and
+// swap them in along with the rest of the data from packages.xml
+func (db *PackageDB) install(byName map[string]*Pkg, xx *xmlDB) {
+	byUid := make(map[uint32][]*Pkg)
+	byInstaller := make(map[string][]*Pkg)
+	byPath := make(map[string]*Pkg)
+	byCertHash := make(map[string][]*Pkg)
+	byCertHash256 := make(map[string][]*Pkg)
+	bySEinfo := make(map[string][]*Pkg)
+	byPerm := make(map[string][]*Pkg)
+	byGid := make(map[uint32][]*Pkg)
+
+	var self *Pkg
+	for _, p := range byName {
+		p.db = db
+		if p.pseudo {
+			self = p
+		}
+		byUid[p.Uid] = append(byUid[p.Uid], p)
+		if len(p.Installer) > 0 {
+			byInstaller[p.Installer] = append(byInstaller[p.Installer], p)
+		}
+		if len(p.Path) > 0 {
+			byPath[path.Clean(p.Path)] = p
+		}
+		for _, h := range p.CertHashes {
+			k := hex.EncodeToString(h)
+			byCertHash[k] = append(byCertHash[k], p)
+		}
+		if len(p.Certhash256) > 0 {
+			k := hex.EncodeToString(p.Certhash256)
+			byCertHash256[k] = append(byCertHash256[k], p)
+		}
+		if len(p.SEinfo) > 0 && p.SEinfo != "none" {
+			bySEinfo[p.SEinfo] = append(bySEinfo[p.SEinfo], p)
+		}
+		for _, nm := range p.Permissions {
+			byPerm[nm] = append(byPerm[nm], p)
+		}
+		for _, g := range p.Gid {
+			// a gid listed twice for a package is indexed once
+			if v := byGid[g]; len(v) == 0 || v[len(v)-1] != p {
+				byGid[g] = append(v, p)
+			}
+		}
+	}
+
+	// Make the uid lookups stable and free of duplicates
+	for uid, pv := range byUid {
+		sort.Slice(pv, func(i, j int) bool {
+			return pv[i].Name < pv[j].Name
+		})
+		byUid[uid] = slices.Compact(pv)
+	}
+
+	db.mu.Lock()
+	db.byName = byName
+	db.byUid = byUid
+	db.byInstaller = byInstaller
+	db.byPath = byPath
+	db.byCertHash = byCertHash
+	db.byCertHash256 = byCertHash256
+	db.bySEinfo = bySEinfo
+	db.byPerm = byPerm
+	db.byGid = byGid
+	db.warn = xx.warn
+	db.certs = xx.certs
+	db.xmlUsed = xx.file
+	db.keysets = xx.keysets
+	db.partial = xx.partial
+	db.orphans = xx.orphans
+	db.hdr = xx.hdr
+	db.shared = xx.shared
+	db.updated = xx.updated
+	db.renamed = xx.renamed
+	db.stats = makeStats(byName, xx)
+	db.self = self
+	db.lastUpd = db.clock().UTC()
+	db.mu.Unlock()
+}
+
+// A reader that fails once its context is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// If 'ifd' is gzip compressed, return a reader that decompresses it;
+// else return a reader that yields the contents unchanged.
+func gunzip(ifd io.Reader) (io.Reader, error) {
+	rd := bufio.NewReader(ifd)
+
+	// Short inputs can't be gzip'd; let the parser deal with them
+	magic, err := rd.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return rd, nil
+	}
+
+	return gzip.NewReader(rd)
+}
+
+// Longest line we accept in packages.list
+const maxListLine = 1024 * 1024
+
+// Parse the packages.list file backing the DB
+func (db *PackageDB) parseListFile(cfg *config) ([]*Pkg, []error, error) {
+	//if !exists(fn) { return nil, nil }
+
+	ifd, err := db.open(db.list)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer ifd.Close()
+
+	return parseList(ifd, db.list, cfg)
+}
+
+// Name of packages.list in error messages
+func (db *PackageDB) listName() string {
+	if len(db.list) > 0 {
+		return db.list
+	}
+	return "packages.list"
+}
+
+// Parse packages.list
+// packages.list format:
+//  pkgName   uid  debug(0|1)   dataPath  seInfo  gid[,gid]..
+//
+// In strict mode the first malformed line is a fatal error; else the
+// malformed lines are skipped and their errors returned in 'bad'.
+func parseList(ifd io.Reader, fn string, cfg *config) (pa []*Pkg, bad []error, err error) {
+	if cfg.ctx != nil {
+		ifd = &ctxReader{cfg.ctx, ifd}
+	}
+
+	ifd, err = gunzip(ifd)
+	if err != nil {
+		return nil, nil, &ParseError{File: fn, Err: err}
+	}
+
+	sc := bufio.NewScanner(ifd)
+
+	// dataPath can make for long lines
+	sc.Buffer(make([]byte, 0, 4096), maxListLine)
+
+	// ScanLines strips the trailing CR/LF
+	var line, npkgs int
+	for sc.Scan() {
+		line++
+
+		v := cfg.fields(sc.Bytes())
+		if len(v) == 0 {
+			continue
+		}
+
+		npkgs++
+		if cfg.tooMany(npkgs) {
+			return nil, nil, &ParseError{File: fn, Line: line, Err: ErrTooManyPackages}
+		}
+
+		p, err := parseListLine(v)
+		if err != nil {
+			err = &ParseError{File: fn, Line: line, Package: string(v[0]), Err: err}
+			if cfg.strict {
+				return nil, nil, err
+			}
+			bad = append(bad, err)
+			continue
+		}
+
+		pa = append(pa, p)
+
+		//fmt.Printf("<%d>: %s ..\n", p.Uid, p.Name)
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, nil, &ParseError{File: fn, Line: line + 1, Err: err}
+	}
+
+	return pa, bad, nil
+}
+
+// Make a Pkg out of the fields of one line of packages.list
+func parseListLine(v [][]byte) (*Pkg, error) {
+	// 0 pkgName    (string)
+	// 1 Uid        (uint32)
+	// 2 Debug      (0|1)
+	// 3 dataPath   (string)
+	// 4 seInfo     (string)
+	// 5 gid_str    (string) -- comma separated or "none"
+	// 6 seInfoUser (string) -- newer releases only
+	//
+	// Older releases omit the gid_str entirely.
+
+	if len(v) < 5 {
+		return nil, fmt.Errorf("Malformed line: expected at least 5 fields, saw %d", len(v))
+	}
+
+	u, err := strconv.ParseUint(string(v[1]), 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse UID <%s>: %w", string(v[1]), err)
+	}
+
+	var gid []uint32
+	if len(v) > 5 && string(v[5]) != "none" {
+		z := bytes.Split(v[5], []byte(","))
+		for _, gs := range z {
+			g, err := strconv.ParseUint(string(gs), 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot parse GID <%s>: %w", string(gs), err)
+			}
+			gid = append(gid, uint32(g))
+		}
+	}
+
+	p := &Pkg{}
+	p.Name = string(v[0])
+	p.Uid = uint32(u)
+	p.DataPath = string(v[3])
+	p.SEinfo = string(v[4])
+	p.Gid = gid
+	p.Debug = string(v[2]) == "1"
+	p.Enabled = true
+	if len(v) > 6 {
+		p.SEinfoUser = string(v[6])
+	}
+	return p, nil
+}
+
+// Return True if file exists and readable; False otherwise
+// XXX See how fukked-up the go APIs are? Why did they choose to
+//     ignore so many good role models (eg., Python os.path)?
+func exists(fn string) bool {
+	st, err := os.Stat(fn)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if !st.Mode().IsRegular() {
+		return false
+	}
+
+	return true
+}
+
+// Header info
+type xPackageVer struct {
+	SdkVer  string `xml:"sdkVersion,attr,omitempty"`
+	DBVer   string `xml:"databaseVersion,attr,omitempty"`
+	FP      string `xml:"fingerprint,attr,omitempty"`
+	VolUUID string `xml:"volumeUuid,attr,omitempty"`
+}
+
+// Convert the header attributes into a Header
+func (x *xPackageVer) header() (Header, error) {
+	var err error
+
+	h := Header{
+		Fingerprint: x.FP,
+		VolumeUuid:  x.VolUUID,
+	}
+
+	if len(x.SdkVer) > 0 {
+		if h.SdkVersion, err = strconv.Atoi(x.SdkVer); err != nil {
+			return h, fmt.Errorf("Cannot parse sdkVersion <%s>: %w", x.SdkVer, err)
+		}
+	}
+	if len(x.DBVer) > 0 {
+		if h.DatabaseVersion, err = strconv.Atoi(x.DBVer); err != nil {
+			return h, fmt.Errorf("Cannot parse databaseVersion <%s>: %w", x.DBVer, err)
+		}
+	}
+	return h, nil
+}
+
+// Shared user declaration
+type xSharedUser struct {
+	Name string `xml:"name,attr"`
+	Uid  string `xml:"userId,attr"`
+}
+
+// A system package that was updated; the updated package itself is a
+// regular <package>
+type xUpdatedPkg struct {
+	Name string `xml:"name,attr"`
+	Path string `xml:"codePath,attr,omitempty"`
+}
+
+// A package that was renamed via <original-package> in its manifest
+type xRenamedPkg struct {
+	New string `xml:"new,attr"`
+	Old string `xml:"old,attr"`
+}
+
+// Array of these structures
+type xpkg struct {
+	Name       string `xml:"name,attr"`
+	Path       string `xml:"codePath,attr,omitempty"`
+	NativePath string `xml:"nativeLibraryPath,attr,omitempty"`
+	PrimAbi    string `xml:"primaryCpuAbi,attr,omitempty"`
+	SecAbi     string `xml:"secondaryCpuAbi,attr,omitempty"`
+	AbiOvr     string `xml:"cpuAbiOverride,attr,omitempty"`
+	VolUUID    string `xml:"volumeUuid,attr,omitempty"`
+	PubFlags   string `xml:"publicFlags,attr,omitempty"` // java int; can be negative
+	Uid        string `xml:"userId,attr,omitempty"`
+	SharedUid  string `xml:"sharedUserId,attr,omitempty"`
+	Inst       string `xml:"installer,attr,omitempty"`
+	InstInit   string `xml:"installInitiator,attr,omitempty"`
+	InstOrig   string `xml:"installOriginator,attr,omitempty"`
+	InstReason string `xml:"installReason,attr,omitempty"`
+	Orphaned   string `xml:"isOrphaned,attr,omitempty"`
+	Version    string `xml:"version,attr,omitempty"`
+	VerCode    string `xml:"versionCode,attr,omitempty"`
+
+	// InstInit and InstOrig are what Android 11's Settings.java
+	// writes; some tools spell them out as below.
+	InstInitName string `xml:"installInitiatingPackageName,attr,omitempty"`
+	InstOrigName string `xml:"installOriginatorPackageName,attr,omitempty"`
+
+	// timestamps: hex encoded milliseconds since epoch
+	FileTime    string `xml:"ft,attr,omitempty"`
+	InstallTime string `xml:"it,attr,omitempty"`
+	UpdateTime  string `xml:"ut,attr,omitempty"`
+
+	// Parsed cert or null
+	//Cert    *x509.Certificate
+
+	// The cert is DER encoded and then hexified.
+	// So, to get the actual cert, we do unhex -> UnDER
+	//Cert    string      `xml:"key,attr">sigs>cert`
+	//
+	// Packages with multiple signers (or rotated keys) have more than
+	// one <cert>.
+	Sigs *xsigs `xml:"sigs"`
+
+	// KeySets that signed the package and those it defined
+	SigningKeySet  *xKeyRef  `xml:"proper-signing-keyset"`
+	DefinedKeySets []xKeyRef `xml:"defined-keyset"`
+
+	// Enabled state of the app and its components
+	Enabled      string  `xml:"enabled,attr,omitempty"`
+	DisabledComp []xitem `xml:"disabled-components>item"`
+	EnabledComp  []xitem `xml:"enabled-components>item"`
+
+	// Granted permissions; older releases only
+	Perms []xperm `xml:"perms>item"`
+
+	// Split APKs
+	Splits []xitem `xml:"split"`
 
-	if p.Cert != nil {
-		crt = fmt.Sprintf(" [SN/%s: hash/%x]", p.Cert.Subject.CommonName, p.Certhash)
-	}
-	return fmt.Sprintf("%s: %v%s", p.Name, p.Uid, crt)
+	// Everything else
+	Other []xelem `xml:",any"`
 }
 
-// Open the Android Package DB represented by two files
-// 'packages.xml' and 'packages.list' -- respectively 'xml', 'list'
-// input args
-func OpenPackageDB(xml, list string) (*PackageDB, error) {
-	db := &PackageDB{list: list, xml: xml}
+// An element we only want the name of
+type xelem struct {
+	XMLName xml.Name
+}
 
-	err := db.refresh()
-	return db, err
+// Elements in packages.xml that we know about but don't parse; any
+// others are reported by Warnings()
+var ignoredElems = map[string]bool{
+	"permissions":                     true,
+	"permission-trees":                true,
+	"preferred-activities":            true,
+	"persistent-preferred-activities": true,
+	"crossProfile-intent-filters":     true,
+	"default-browser":                 true,
+	"domain-verifications":            true,
+	"verifier":                        true,
+	"read-external-storage":           true,
+	"restored-ivi":                    true,
+	"database-version":                true,
+	"last-platform-version":           true,
+	"cleaning-package":                true,
+	"blocked-uninstall-packages":      true,
 }
 
-// XXX What to implement here?
-func (db *PackageDB) Close() {
-	db.byName = nil
-	db.byUid = nil
+// Likewise for the children of <package>
+var ignoredPkgElems = map[string]bool{
+	"signing-keyset":         true,
+	"upgrade-keyset":         true,
+	"domain-verification":    true,
+	"install-initiator-sigs": true,
+	"mime-group":             true,
+	"split-version":          true,
+	"uses-static-lib":        true,
+	"uses-sdk-lib":           true,
 }
 
-// Given an UID, return the list of packages that use it
-func (db *PackageDB) GetListByUid(uid uint32) []*Pkg {
-	db.maybeRefresh()
+// The <sigs> of a package
+type xsigs struct {
+	Count  string `xml:"count,attr,omitempty"`
+	Scheme string `xml:"schemeVersion,attr,omitempty"` // Android P+
 
-	if r, ok := db.byUid[uid]; ok {
-		return r
-	}
+	Certs []cert `xml:"cert"`
 
-	return nil
+	// Past signing certs (oldest first) for packages that rotated
+	// their signing key.
+	PastSigs []cert `xml:"pastSigs>cert"`
 }
 
-func (db *PackageDB) GetByName(nm string) *Pkg {
-	db.maybeRefresh()
-
-	if r, ok := db.byName[nm]; ok {
-		return r
-	}
-	return nil
+// A permission <item> under <perms>
+type xperm struct {
+	Name    string `xml:"name,attr"`
+	Granted string `xml:"granted,attr,omitempty"`
+	Flags   string `xml:"flags,attr,omitempty"`
 }
 
-func (db *PackageDB) LastUpdate() time.Time {
-	return db.lastUpd
+// Generic <item name=".."/> child
+type xitem struct {
+	Name string `xml:"name,attr"`
 }
 
-// Given a Package UID, return the first matching uid
-func (db *PackageDB) GetByUid(uid uint32) *Pkg {
-	db.maybeRefresh()
+// Return the names of a list of <item>s
+func itemNames(v []xitem) []string {
+	if len(v) == 0 {
+		return nil
+	}
 
-	if r, ok := db.byUid[uid]; ok {
-		return r[0]
+	s := make([]string, len(v))
+	for i, x := range v {
+		s[i] = x.Name
 	}
-	return nil
+	return s
 }
 
-// Start an iterator - based on Name
-// Creates and returns a channel and feeds it data via a go routine
-func (db *PackageDB) IterateByName() chan *Pkg {
-	ch := make(chan *Pkg, 1)
+// Only the first <cert> for a given signing key carries the hex key
+// blob; later references to the same key just carry the index.
+type cert struct {
+	Index string `xml:"index,attr"`
+	Cert  string `xml:"key,attr,omitempty"`
+}
 
-	go func(db *PackageDB, ch chan *Pkg) {
-		for _, p := range db.byName {
-			ch <- p
-		}
-		close(ch)
-	}(db, ch)
+// Everything we glean from packages.xml
+type xmlDB struct {
+	pkgs []*Pkg
+	hdr  Header
 
-	return ch
-}
+	// shared uid -> shared user name
+	shared map[uint32]string
 
-// Start an iterator - based on Uid
-// Creates and returns a channel and feeds it data via a go routine
-func (db *PackageDB) IterateByUid() chan []*Pkg {
-	ch := make(chan []*Pkg, 1)
+	// <updated-package> names and <renamed-package> new -> old
+	updated map[string]bool
+	renamed map[string]string
 
-	go func(db *PackageDB, ch chan []*Pkg) {
-		for _, p := range db.byUid {
-			ch <- p
-		}
-		close(ch)
-	}(db, ch)
+	// malformed packages skipped in lenient mode
+	bad []error
 
-	return ch
+	// every cert referenced by the packages
+	certs certCache
+
+	// the file this came from
+	file string
+
+	// keyset id -> keyset
+	keysets map[string]*KeySet
+
+	// true if packages.xml or packages.list couldn't be read
+	partial bool
+
+	// uids in only one of packages.xml and packages.list
+	orphans []uint32
+
+	// non-fatal problems
+	warn []string
+
+	// packages whose certs couldn't be decoded
+	certErrs []error
+
+	// time taken to parse both files
+	took time.Duration
 }
 
-// If the packages.{list,xml} is newer than what we have, update our
-// in-core data.
-func (db *PackageDB) maybeRefresh() {
-	st0, err := os.Stat(db.list)
+// Parse the packages.xml file backing the DB; if that fails and
+// WithBackupFallback() is set, try packages-backup.xml next to it.
+func (db *PackageDB) parseXMLFile(cfg *config) (*xmlDB, error) {
+	xx, err := db.parseXMLAt(db.xml, cfg)
+	if err == nil || !cfg.backup || cfg.done() != nil {
+		return xx, err
+	}
+
+	if bx, berr := db.parseXMLAt(db.backupXML(), cfg); berr == nil {
+		return bx, nil
+	}
+	return nil, err
+}
+
+// Parse the packages.xml file 'fn'
+func (db *PackageDB) parseXMLAt(fn string, cfg *config) (*xmlDB, error) {
+
+	//if !exists(fn) { return nil, nil }
+
+	ifd, err := db.open(fn)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	st1, err := os.Stat(db.xml)
+	defer ifd.Close()
+
+	db.mu.RLock()
+	certs := db.certs
+	db.mu.RUnlock()
+
+	xx, err := parseXML(ifd, fn, cfg, certs)
 	if err != nil {
-		return
+		return nil, err
 	}
+	xx.file = fn
+	return xx, nil
+}
 
-	mt0 := st0.ModTime()
-	mt1 := st1.ModTime()
-	if mt0.After(db.lastUpd) || mt1.After(db.lastUpd) {
-		db.refresh()
+// Return the name of the backup of packages.xml that Android keeps
+// while it writes a new one
+func (db *PackageDB) backupXML() string {
+	if db.fsys != nil {
+		return path.Join(path.Dir(db.xml), "packages-backup.xml")
 	}
+	return filepath.Join(filepath.Dir(db.xml), "packages-backup.xml")
 }
 
-// Read and update the package DB
-func (db *PackageDB) refresh() error {
-	ll, err := parseList(db.list)
-	if err != nil {
-		return err
+// Parse packages.xml from 'ifd'; 'fn' names the source in error
+// messages. Malformed packages are handled like in parseList(). Certs
+// found in 'certs' (from a previous parse) aren't parsed again.
+func parseXML(ifd io.Reader, fn string, cfg *config, certs certCache) (*xmlDB, error) {
+	if cfg.ctx != nil {
+		ifd = &ctxReader{cfg.ctx, ifd}
 	}
 
-	xx, err := parseXML(db.xml)
+	ifd, err := gunzip(ifd)
 	if err != nil {
-		return err
+		return nil, &ParseError{File: fn, Err: err}
 	}
 
-	// We always make new maps and discard the previous ones.
-	// This is the only clean way to guarantee that when apps are
-	// deleted, our data is valid.
-	byName := make(map[string]*Pkg)
-	byUid := make(map[uint32][]*Pkg)
+	d := xml.NewDecoder(ifd)
+	xdb := &xmlDB{
+		shared:  make(map[uint32]string),
+		updated: make(map[string]bool),
+		renamed: make(map[string]string),
+	}
 
-	// Start with canonical representation from packages.xml
-	for _, p := range xx {
-		byName[p.Name] = p
+	// Annotate errors with the current position
+	perr := func(err error) error {
+		line, _ := d.InputPos()
+		return &ParseError{File: fn, Line: line, Err: err}
 	}
 
-	// And merge data from packages.list into it
-	for _, p := range ll {
-		if a, ok := byName[p.Name]; ok {
-			a.Gid = p.Gid
-			a.DataPath = p.DataPath
-		} else {
-			byName[p.Name] = p
+	keys := newCertTab(certs)
+	keys.lazy = cfg.lazyCerts
+
+	// Find the root element
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, perr(err)
 		}
-	}
 
-	// Finally, add a reverse lookup
-	for _, p := range byName {
-		byUid[p.Uid] = append(byUid[p.Uid], p)
+		if se, ok := tok.(xml.StartElement); ok {
+			if se.Name.Local != "packages" {
+				return nil, perr(fmt.Errorf("expected element type <packages> but have <%s>", se.Name.Local))
+			}
+			break
+		}
 	}
 
-	// Finally, if we are NOT on Android, add the calling process to
-	// the DB for debugging purposes
-	if p := getself(); p != nil {
-		byUid[p.Uid] = append(byUid[p.Uid], p)
-		byName[p.Name] = p
+	// Elements we don't know about are noted once
+	seen := make(map[string]bool)
+	unknown := func(nm string) {
+		if !seen[nm] {
+			seen[nm] = true
+			xdb.warn = append(xdb.warn, fmt.Sprintf("%s: unknown element <%s>", fn, nm))
+		}
 	}
 
-	db.byName = byName
-	db.byUid = byUid
-	db.lastUpd = time.Now().UTC()
+	// And process its children one at a time
+	var nver, npkgs int
+	var refs []pkgKeyRefs
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, perr(err)
+		}
 
-	return nil
-}
+		switch se := tok.(type) {
+		case xml.StartElement:
+			switch se.Name.Local {
+			case "version":
+				var v xPackageVer
+				if err := d.DecodeElement(&v, &se); err != nil {
+					return nil, perr(err)
+				}
 
-// Generator to yield lines into a channel
-func genlines(ifd io.Reader) chan []byte {
-	rr := bufio.NewReader(ifd)
-	ch := make(chan []byte, 10)
+				// The first <version> describes internal storage
+				if nver == 0 {
+					if xdb.hdr, err = v.header(); err != nil {
+						return nil, perr(err)
+					}
+				}
+				nver++
 
-	fn := func(r *bufio.Reader, ch chan []byte) {
-		for {
-			b, err := r.ReadBytes('\n')
-			x := len(b)
-			if x == 0 {
-				if err == io.EOF {
-					break
+			case "shared-user":
+				var x xSharedUser
+				if err := d.DecodeElement(&x, &se); err != nil {
+					return nil, perr(err)
 				}
-				continue
-			}
 
-			if b[x-1] == '\n' {
-				b = b[:x-1]
-				x -= 1
-			}
+				u, err := strconv.ParseUint(x.Uid, 0, 32)
+				if err != nil {
+					return nil, perr(fmt.Errorf("%s: Cannot parse shared userId <%s>: %w", x.Name, x.Uid, err))
+				}
+				xdb.shared[uint32(u)] = x.Name
 
-			if x == 0 {
-				continue
-			}
+			case "updated-package":
+				var x xUpdatedPkg
+				if err := d.DecodeElement(&x, &se); err != nil {
+					return nil, perr(err)
+				}
+				xdb.updated[x.Name] = true
 
-			if b[x-1] == '\r' {
-				b = b[:x-1]
-				x -= 1
-			}
+			case "renamed-package":
+				var x xRenamedPkg
+				if err := d.DecodeElement(&x, &se); err != nil {
+					return nil, perr(err)
+				}
+				xdb.renamed[x.New] = x.Old
+
+			case "keyset-settings":
+				var x xKeySetSettings
+				if err := d.DecodeElement(&x, &se); err != nil {
+					return nil, perr(err)
+				}
+				if xdb.keysets, err = x.keySets(); err != nil {
+					return nil, perr(err)
+				}
 
-			if x == 0 {
-				continue
+			case "package":
+				if err := cfg.done(); err != nil {
+					return nil, err
+				}
+
+				npkgs++
+				if cfg.tooMany(npkgs) {
+					return nil, perr(ErrTooManyPackages)
+				}
+
+				var x xpkg
+				if err := d.DecodeElement(&x, &se); err != nil {
+					return nil, perr(err)
+				}
+				for _, o := range x.Other {
+					if !ignoredPkgElems[o.XMLName.Local] {
+						unknown("package/" + o.XMLName.Local)
+					}
+				}
+
+				y, err := x.toPkg(keys)
+				if err != nil {
+					err = &ParseError{File: fn, Package: x.Name, Err: err}
+					if cfg.strict {
+						return nil, err
+					}
+
+					// uid-less packages are harmless; skip them quietly
+					if errors.Is(err, ErrNoUid) {
+						xdb.warn = append(xdb.warn, fmt.Sprintf("%s: %s has no uid; skipped", fn, x.Name))
+						continue
+					}
+
+					// keep packages with bad certs; skip the rest
+					var ce *certError
+					if !errors.As(err, &ce) {
+						xdb.bad = append(xdb.bad, err)
+						continue
+					}
+					xdb.certErrs = append(xdb.certErrs, err)
+				}
+				xdb.pkgs = append(xdb.pkgs, y)
+				if x.SigningKeySet != nil || len(x.DefinedKeySets) > 0 {
+					r := pkgKeyRefs{p: y, defined: x.DefinedKeySets}
+					if x.SigningKeySet != nil {
+						r.signing = x.SigningKeySet.ID
+					}
+					refs = append(refs, r)
+				}
+
+			default:
+				if !ignoredElems[se.Name.Local] {
+					unknown(se.Name.Local)
+				}
+				if err := d.Skip(); err != nil {
+					return nil, perr(err)
+				}
 			}
 
-			ch <- b
+		case xml.EndElement:
+			// end of <packages>
+			linkKeySets(refs, xdb.keysets)
+
+			// Packages without a volume are on the header's
+			for _, p := range xdb.pkgs {
+				if len(p.VolumeUuid) == 0 {
+					p.VolumeUuid = xdb.hdr.VolumeUuid
+				}
+			}
+			xdb.certs = keys.cur
+			return xdb, nil
 		}
-		close(ch)
 	}
+}
 
-	go fn(rr, ch)
+// Convert a parsed <package> element into a Pkg; 'keys' holds the
+// certs seen so far.
+func (x *xpkg) toPkg(keys *certTab) (*Pkg, error) {
+	var err error
+
+	y := &Pkg{}
+	y.Name = x.Name
+	y.Path = x.Path
+	y.NativeLibraryPath = x.NativePath
+	y.PrimaryCpuAbi = x.PrimAbi
+	y.SecondaryCpuAbi = x.SecAbi
+	y.CpuAbiOverride = x.AbiOvr
+	y.VolumeUuid = x.VolUUID
+	y.Installer = x.Inst
+	y.InitiatingInstaller = x.InstInit
+	if len(y.InitiatingInstaller) == 0 {
+		y.InitiatingInstaller = x.InstInitName
+	}
+	y.OriginatingInstaller = x.InstOrig
+	if len(y.OriginatingInstaller) == 0 {
+		y.OriginatingInstaller = x.InstOrigName
+	}
+	y.IsOrphaned = x.Orphaned == "true"
+	if len(x.InstReason) > 0 {
+		if y.InstallReason, err = strconv.Atoi(x.InstReason); err != nil {
+			return nil, fmt.Errorf("Can't parse installReason <%s>: %w", x.InstReason, err)
+		}
+	}
+	if y.Flags, err = parseFlags(x.PubFlags); err != nil {
+		return nil, fmt.Errorf("Can't parse publicFlags <%s>: %w", x.PubFlags, err)
+	}
+	y.Splits = itemNames(x.Splits)
+	y.DisabledComponents = itemNames(x.DisabledComp)
+	y.EnabledComponents = itemNames(x.EnabledComp)
+
+	y.Permissions = grantedPerms(x.Perms)
+
+	// enabled is one of the EnabledStateXXX values; really old files
+	// use true/false
+	switch x.Enabled {
+	case "", "true":
+		y.Enabled = true
+	case "false":
+		y.Enabled = false
+		y.enabled = EnabledStateDisabled
+	default:
+		st, err := strconv.Atoi(x.Enabled)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse enabled <%s>: %w", x.Enabled, err)
+		}
+		y.Enabled = st == EnabledStateDefault || st == EnabledStateEnabled
+		y.enabled = st
+	}
 
-	return ch
-}
+	// version is either a numeric code or a version string
+	if len(x.Version) > 0 {
+		if v, err := strconv.ParseInt(x.Version, 10, 64); err == nil {
+			y.VersionCode = v
+		} else {
+			y.Version = x.Version
+		}
+	}
 
-// Parse packages.list
-// packages.list format:
-//  pkgName   uid  debug(0|1)   dataPath  seInfo  gid[,gid]..
-func parseList(fn string) ([]*Pkg, error) {
-	//if !exists(fn) { return nil, nil }
+	if len(x.VerCode) > 0 {
+		v, err := strconv.ParseInt(x.VerCode, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse versionCode <%s>: %w", x.VerCode, err)
+		}
+		y.VersionCode = v
+	}
 
-	ifd, err := os.Open(fn)
+	uid, err := parseUid(x.Uid)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Can't parse userId <%s>: %w", x.Uid, err)
+	}
+	if y.SharedUid, err = parseUid(x.SharedUid); err != nil {
+		return nil, fmt.Errorf("Can't parse sharedUserId <%s>: %w", x.SharedUid, err)
 	}
 
-	defer ifd.Close()
+	if uid > 0 {
+		y.Uid = uid
+	} else if y.SharedUid > 0 {
+		y.Uid = y.SharedUid
+	} else {
+		return nil, ErrNoUid
+	}
 
-	// Async scan of the file and generate full lines
-	ch := genlines(ifd)
+	// Older files don't have "it"; the code path timestamp is
+	// the next best thing.
+	it := x.InstallTime
+	if len(it) == 0 {
+		it = x.FileTime
+	}
+	if y.FirstInstallTime, err = parseHexTime(it); err != nil {
+		return nil, fmt.Errorf("Can't parse install time <%s>: %w", it, err)
+	}
+	if y.LastUpdateTime, err = parseHexTime(x.UpdateTime); err != nil {
+		return nil, fmt.Errorf("Can't parse update time <%s>: %w", x.UpdateTime, err)
+	}
 
-	// Conservatively
-	var pa []*Pkg
+	if x.Sigs == nil {
+		return y, nil
+	}
 
-	for l := range ch {
-		v := bytes.Fields(l)
-		if len(v) == 0 {
-			continue
+	s := x.Sigs
+	if len(s.Count) > 0 {
+		if y.SignerCount, err = strconv.Atoi(s.Count); err != nil {
+			return nil, fmt.Errorf("Can't parse sigs count <%s>: %w", s.Count, err)
+		}
+	}
+	if len(s.Scheme) > 0 {
+		v, err := strconv.Atoi(s.Scheme)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse schemeVersion <%s>: %w", s.Scheme, err)
 		}
+		if v > 0 {
+			y.SignatureSchemes = []string{"v" + s.Scheme}
+		}
+	}
 
-		// 0 pkgName    (string)
-		// 1 Uid        (uint32)
-		// 2 Debug      (0|1)
-		// 3 dataPath   (string)
-		// 4 seInfo     (string)
-		// 5 gid_str    (string) -- comma separated or "none"
+	// A package with bad certs is still usable, just not trusted
+	if err := y.setCerts(s, keys); err != nil {
+		y.Certs, y.CertHashes, y.SigningLineage = nil, nil, nil
+		y.certs, y.lineage = nil, nil
+		return y, &certError{err}
+	}
+	if len(s.Count) == 0 {
+		y.SignerCount = len(y.certs)
+	}
+
+	//fmt.Printf("<%d>:  %s .. [x]\n", x.Uid, x.Name)
+	return y, nil
+}
 
-		u, err := strconv.ParseUint(string(v[1]), 0, 32)
+// Decode the certs and signing lineage in 's' into 'y'; the x509
+// certs are only filled in if 'keys' parsed them.
+func (y *Pkg) setCerts(s *xsigs, keys *certTab) error {
+	for _, c := range s.Certs {
+		lc, err := keys.get(&c)
 		if err != nil {
-			return nil, fmt.Errorf("Cannot parse UID <%s> for %s: %s", string(v[1]), string(v[0]), err)
+			return err
 		}
 
-		var gid []uint32
-		if string(v[5]) != "none" {
-			z := bytes.Split(v[5], []byte(","))
-			for _, gs := range z {
-				g, err := strconv.ParseUint(string(gs), 0, 32)
-				if err != nil {
-					return nil, fmt.Errorf("Cannot parse GID <%s> for %s: %s", string(gs), string(v[0]), err)
-				}
-				gid = append(gid, uint32(g))
+		if lc != nil {
+			ch := sha1.Sum(lc.der)
+			y.certs = append(y.certs, lc)
+			y.CertHashes = append(y.CertHashes, ch[:])
+			if !keys.lazy {
+				y.Certs = append(y.Certs, lc.crt)
 			}
 		}
+	}
 
-		p := &Pkg{}
-		p.Name = string(v[0])
-		p.Uid = uint32(u)
-		p.DataPath = string(v[3])
-		p.SEinfo = string(v[4])
-		p.Gid = gid
-
-		pa = append(pa, p)
+	// The signing lineage, if any, follows the current certs
+	for _, c := range s.PastSigs {
+		lc, err := keys.get(&c)
+		if err != nil {
+			return err
+		}
 
-		//fmt.Printf("<%d>: %s ..\n", p.Uid, p.Name)
+		if lc != nil {
+			y.lineage = append(y.lineage, lc)
+			if !keys.lazy {
+				y.SigningLineage = append(y.SigningLineage, lc.crt)
+			}
+		}
+	}
+	if len(y.lineage) == 0 {
+		y.lineage = y.certs
+		y.SigningLineage = y.Certs
 	}
 
-	return pa, nil
-}
+	// The first cert is the canonical one
+	if len(y.certs) > 0 {
+		y.CertDER = y.certs[0].der
+		y.Certhash = y.CertHashes[0]
+		if len(y.Certs) > 0 {
+			y.Cert = y.Certs[0]
+		}
 
-// Return True if file exists and readable; False otherwise
-// XXX See how fukked-up the go APIs are? Why did they choose to
-//     ignore so many good role models (eg., Python os.path)?
-func exists(fn string) bool {
-	st, err := os.Stat(fn)
-	if os.IsNotExist(err) {
-		return false
+		h := sha256.Sum256(y.CertDER)
+		y.Certhash256 = h[:]
 	}
-	if !st.Mode().IsRegular() {
-		return false
+	return nil
+}
+
+// Parse a uid attribute: decimal or 0x prefixed hex. Empty string
+// yields zero.
+func parseUid(s string) (uint32, error) {
+	if len(s) == 0 {
+		return 0, nil
 	}
 
-	return true
+	u, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(u), nil
 }
 
-// XML Package top level struct
-type xPackage struct {
-	XMLName xml.Name      `xml:"packages"`
-	Ver     []xPackageVer `xml:"version"`
+// Parse a flags attribute: a java int in decimal (and so possibly
+// negative) or 0x prefixed hex. Empty string yields zero.
+func parseFlags(s string) (uint32, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
 
-	Pkgs []xpkg `xml:"package"`
+	v, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v < math.MinInt32 || v > math.MaxUint32 {
+		return 0, fmt.Errorf("%s: %w", s, strconv.ErrRange)
+	}
+	return uint32(v), nil
 }
 
-// Header info
-type xPackageVer struct {
-	SdkVer  string `xml:"sdkVersion,attr"`
-	DBVer   string `xml:"databaseVersion,attr"`
-	FP      string `xml:"fingerprint,attr"`
-	VolUUID string `xml:"volumeUuid,attr"`
-}
+// Certs keyed by their hex encoded DER blob
+type certCache map[string]*lazyCert
 
-// Array of these structures
-type xpkg struct {
-	Name       string `xml:"name,attr"`
-	Path       string `xml:"codePath,attr"`
-	NativePath string `xml:"nativeLibraryPath,attr"`
-	PubFlags   uint32 `xml:"publicFlags,attr"`
-	Uid        uint32 `xml:"userId,attr"`
-	SharedUid  uint32 `xml:"sharedUserId,attr"`
-	Inst       string `xml:"installer,attr"`
-	Version    string `xml:"version,attr"`
+// Certs seen while parsing packages.xml
+type certTab struct {
+	// cert index -> cert
+	idx map[string]*lazyCert
 
-	// Parsed cert or null
-	//Cert    *x509.Certificate
+	// certs from the previous parse and this one
+	old certCache
+	cur certCache
 
-	// The cert is DER encoded and then hexified.
-	// So, to get the actual cert, we do unhex -> UnDER
-	//Cert    string      `xml:"key,attr">sigs>cert`
-	Certstr cert `xml:"sigs>cert"`
+	// leave the certs for lazyCert.get() to parse
+	lazy bool
 }
 
-type cert struct {
-	Cert string `xml:"key,attr"`
+func newCertTab(old certCache) *certTab {
+	return &certTab{
+		idx: make(map[string]*lazyCert),
+		old: old,
+		cur: make(certCache),
+	}
 }
 
-// Parse packages.xml
-func parseXML(fn string) ([]*Pkg, error) {
-
-	//if !exists(fn) { return nil, nil }
+// Return the cert described by 'c'; nil if it has neither a key nor an
+// index. Certs are only decoded (and, unless lazy, parsed) the first
+// time we see them.
+func (t *certTab) get(c *cert) (*lazyCert, error) {
+	if len(c.Cert) == 0 {
+		if len(c.Index) == 0 {
+			return nil, nil
+		}
 
-	data, err := ioutil.ReadFile(fn)
-	if err != nil {
-		return nil, err
+		lc, ok := t.idx[c.Index]
+		if !ok {
+			return nil, fmt.Errorf("Can't find cert with index %s", c.Index)
+		}
+		return lc, nil
 	}
 
-	var v xPackage
-
-	err = xml.Unmarshal(data, &v)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot parse %s: %s", fn, err)
+	lc, ok := t.cur[c.Cert]
+	if !ok {
+		lc, ok = t.old[c.Cert]
+	}
+	if !ok {
+		b, err := hex.DecodeString(c.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode cert hex: %w", err)
+		}
+		lc = &lazyCert{der: b}
 	}
 
-	g := make([]*Pkg, len(v.Pkgs))
-
-	for i, x := range v.Pkgs {
-		y := &Pkg{}
-		g[i] = y
-
-		y.Name = x.Name
-		y.Path = x.Path
-		if x.Uid > 0 {
-			y.Uid = x.Uid
-		} else if x.SharedUid > 0 {
-			y.Uid = x.SharedUid
-		} else {
-			return nil, fmt.Errorf("%s: uid and sharedUid are both Nil!\n", x.Name)
+	if !t.lazy {
+		if _, err := lc.get(); err != nil {
+			return nil, err
 		}
+	}
 
-		// Now try to decode the cert
-		if len(x.Certstr.Cert) > 0 {
-			b, err := hex.DecodeString(x.Certstr.Cert)
-			if err != nil {
-				return nil, fmt.Errorf("%s: Can't decode cert hex: %s", x.Name, err)
-			}
+	t.cur[c.Cert] = lc
+	if len(c.Index) > 0 {
+		t.idx[c.Index] = lc
+	}
+	return lc, nil
+}
 
-			if len(b) > 0 {
-				crt, err := x509.ParseCertificate(b[:])
-				if err != nil {
-					return nil, fmt.Errorf("%s: Can't parse X509 DER cert: %s", x.Name, err)
-				}
+// A package's certs couldn't be decoded; the package itself is fine
+type certError struct {
+	error
+}
 
-				ch := sha1.Sum(b)
-				y.Cert = crt
-				y.Certhash = ch[:]
-			}
-		}
+func (e *certError) Unwrap() error {
+	return e.error
+}
 
-		//fmt.Printf("<%d>:  %s .. [x]\n", x.Uid, x.Name)
+// Parse a hex encoded millisecond epoch into UTC time; empty string
+// yields the zero time.
+func parseHexTime(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
 	}
 
-	return g, nil
+	ms, err := strconv.ParseInt(s, 16, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms).UTC(), nil
 }
@@ -14,10 +14,35 @@
 package pkg_test
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
 	"os"
+	"path"
+	"path/filepath"
 	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	// module under test
 	"android/pkg"
@@ -38,8 +63,30 @@ func assert(cond bool, t *testing.T, msg string) {
 	t.Fatalf("%s: %d: Assertion failed: %q\n", file, line, msg)
 }
 
+// Make a self-signed DER cert for 'cn' valid between nb and na
+func mkcert(t *testing.T, cn string, nb, na time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	return mkcertKey(t, key, 1, pkix.Name{CommonName: cn}, nb, na)
+}
+
+// Make a self-signed DER cert for 'key'
+func mkcertKey(t *testing.T, key *ecdsa.PrivateKey, serial int64, subj pkix.Name, nb, na time.Time) []byte {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subj,
+		NotBefore:    nb,
+		NotAfter:     na,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	return der
+}
+
 func Test0(t *testing.T) {
-	pkg, err := pkg.OpenPackageDB("./packages.xml", "./packages.list")
+	pkg, err := pkg.OpenPackageDB("../packages.xml", "../packages.list")
 	assert(err == nil, t, fmt.Sprintf("%s", err))
 
 	uid := uint32(os.Getuid())
@@ -47,3 +94,2605 @@ func Test0(t *testing.T) {
 	assert(pv != nil, t, fmt.Sprintf("can't find uid %v", uid))
 	assert(len(pv) == 1, t, fmt.Sprintf("more than one pkg with uid %v", uid))
 }
+
+// Copy the named fixtures from testdata into a fresh temp dir and
+// return the dir.
+func copyFixtures(t *testing.T, names ...string) string {
+	dir := t.TempDir()
+	for _, nm := range names {
+		b, err := os.ReadFile(filepath.Join("testdata", nm))
+		assert(err == nil, t, fmt.Sprintf("%s", err))
+
+		err = os.WriteFile(filepath.Join(dir, nm), b, 0600)
+		assert(err == nil, t, fmt.Sprintf("%s", err))
+	}
+	return dir
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	dir := copyFixtures(t, "packages.xml", "packages.list")
+	xml := filepath.Join(dir, "packages.xml")
+	list := filepath.Join(dir, "packages.list")
+
+	db, err := pkg.OpenPackageDB(xml, list)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	// Push the mtimes into the future; every lookup from here on
+	// re-parses and swaps the maps.
+	fut := time.Now().Add(time.Hour)
+	assert(os.Chtimes(xml, fut, fut) == nil, t, "chtimes xml")
+	assert(os.Chtimes(list, fut, fut) == nil, t, "chtimes list")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				p := db.GetByName("com.example.notes")
+				if p == nil || p.Uid != 10050 {
+					t.Errorf("lookup failed: %v", p)
+					return
+				}
+				for range db.IterateByName() {
+				}
+				_ = db.GetListByUid(1001)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestIterateCancel(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := db.IterateByNameContext(ctx)
+		p := <-ch
+		assert(p != nil, t, "empty iterator")
+		cancel()
+	}
+
+	// give the producers a chance to notice the cancellation
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= before {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	n := runtime.NumGoroutine()
+	assert(n <= before, t, fmt.Sprintf("leaked goroutines: %d > %d", n, before))
+}
+
+func TestInstaller(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p != nil, t, "can't find com.example.notes")
+	assert(p.Installer == "com.android.vending", t, fmt.Sprintf("wrong installer %q", p.Installer))
+
+	p = db.GetByName("com.example.todo")
+	assert(p != nil, t, "can't find com.example.todo")
+	assert(p.Installer == "", t, fmt.Sprintf("unexpected installer %q", p.Installer))
+
+	pv := db.GetByInstaller("com.android.vending")
+	assert(len(pv) == 1, t, fmt.Sprintf("expected 1 pkg, saw %d", len(pv)))
+	assert(pv[0].Name == "com.example.notes", t, "wrong pkg for installer")
+
+	assert(db.GetByInstaller("") == nil, t, "empty installer is indexed")
+}
+
+func TestVersion(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/version.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p != nil, t, "can't find com.example.notes")
+	assert(p.Version == "", t, fmt.Sprintf("unexpected version %q", p.Version))
+	assert(p.VersionCode == 12, t, fmt.Sprintf("wrong version code %d", p.VersionCode))
+
+	p = db.GetByName("com.example.todo")
+	assert(p != nil, t, "can't find com.example.todo")
+	assert(p.Version == "2.1.0", t, fmt.Sprintf("wrong version %q", p.Version))
+	assert(p.VersionCode == 210, t, fmt.Sprintf("wrong version code %d", p.VersionCode))
+}
+
+func TestFlags(t *testing.T) {
+	// publicFlags from a real device packages.xml
+	db, err := pkg.OpenPackageDB("../packages.xml", "../packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	tests := []struct {
+		name  string
+		flags uint32
+		sys   bool
+		dbg   bool
+		code  bool
+		upd   bool
+	}{
+		{"com.android.cts.priv.ctsshim", 940097089, true, false, false, false},
+		{"com.android.webview", 0xb808be45, true, false, true, false},
+		{"com.bits42.adblocksettings", 944291398, false, true, true, false},
+	}
+
+	for _, x := range tests {
+		p := db.GetByName(x.name)
+		assert(p != nil, t, fmt.Sprintf("can't find %s", x.name))
+		assert(p.Flags == x.flags, t, fmt.Sprintf("%s: wrong flags %#x", x.name, p.Flags))
+		assert(p.IsSystemApp() == x.sys, t, fmt.Sprintf("%s: IsSystemApp", x.name))
+		assert(p.IsDebuggable() == x.dbg, t, fmt.Sprintf("%s: IsDebuggable", x.name))
+		assert(p.HasCode() == x.code, t, fmt.Sprintf("%s: HasCode", x.name))
+		assert(p.IsUpdatedSystemApp() == x.upd, t, fmt.Sprintf("%s: IsUpdatedSystemApp", x.name))
+	}
+
+	p := &pkg.Pkg{Flags: pkg.FlagSystem | pkg.FlagUpdatedSystemApp}
+	assert(p.IsUpdatedSystemApp(), t, "IsUpdatedSystemApp")
+}
+
+func TestInstallTime(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p != nil, t, "can't find com.example.notes")
+
+	want := time.UnixMilli(0x1576530d6b0).UTC()
+	assert(p.FirstInstallTime.Equal(want), t, fmt.Sprintf("wrong install time %s", p.FirstInstallTime))
+	assert(p.LastUpdateTime.Equal(want), t, fmt.Sprintf("wrong update time %s", p.LastUpdateTime))
+
+	// no timestamps at all
+	db, err = pkg.OpenPackageDB("testdata/version.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p = db.GetByName("com.example.todo")
+	assert(p != nil, t, "can't find com.example.todo")
+	assert(p.FirstInstallTime.IsZero(), t, "install time is not zero")
+	assert(p.LastUpdateTime.IsZero(), t, "update time is not zero")
+
+	_, err = pkg.OpenPackageDB("testdata/badtime.xml", "testdata/packages.list")
+	assert(err != nil, t, "malformed timestamp parsed")
+	assert(strings.Contains(err.Error(), "com.example.todo"), t, fmt.Sprintf("error doesn't name pkg: %s", err))
+}
+
+func TestMultipleCerts(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/multicert.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p != nil, t, "can't find com.example.notes")
+	assert(len(p.Certs) == 2, t, fmt.Sprintf("expected 2 certs, saw %d", len(p.Certs)))
+	assert(len(p.CertHashes) == 2, t, fmt.Sprintf("expected 2 hashes, saw %d", len(p.CertHashes)))
+	assert(p.Cert == p.Certs[0], t, "Cert is not the first cert")
+	assert(bytes.Equal(p.Certhash, p.CertHashes[0]), t, "Certhash is not the first hash")
+	assert(p.Certs[0].Subject.CommonName == "William Huang", t, "wrong first cert")
+	assert(p.Certs[1].Subject.CommonName == "Android", t, "wrong second cert")
+}
+
+func TestCertIndex(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/keyindex.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	a := db.GetByName("com.example.notes")
+	assert(a != nil, t, "can't find com.example.notes")
+	assert(a.Cert != nil, t, "com.example.notes has no cert")
+
+	b := db.GetByName("com.example.todo")
+	assert(b != nil, t, "can't find com.example.todo")
+	assert(b.Cert != nil, t, "com.example.todo didn't resolve cert index")
+	assert(bytes.Equal(a.Certhash, b.Certhash), t, "cert hashes differ")
+	assert(b.Cert.Subject.CommonName == "William Huang", t, "wrong cert")
+}
+
+func TestReader(t *testing.T) {
+	xf, err := os.Open("testdata/packages.xml")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	defer xf.Close()
+
+	lf, err := os.Open("testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	defer lf.Close()
+
+	before := time.Now().UTC()
+	db, err := pkg.OpenPackageDBReader(xf, lf)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(!db.LastUpdate().Before(before), t, "stale LastUpdate")
+
+	p := db.GetByName("com.example.notes")
+	assert(p != nil, t, "can't find com.example.notes")
+	assert(p.Cert != nil, t, "no cert")
+	assert(p.DataPath == "/data/user/0/com.example.notes", t, fmt.Sprintf("wrong datapath %q", p.DataPath))
+
+	pv := db.GetListByUid(1001)
+	assert(len(pv) == 1, t, fmt.Sprintf("expected 1 pkg for uid 1001, saw %d", len(pv)))
+}
+
+func TestHeader(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	h := db.Header()
+	assert(h.SdkVersion == 24, t, fmt.Sprintf("wrong sdk version %d", h.SdkVersion))
+	assert(h.DatabaseVersion == 3, t, fmt.Sprintf("wrong db version %d", h.DatabaseVersion))
+	assert(h.Fingerprint == "Android/aosp_angler/angler:7.0/NRD90U/ubuntu09260552:userdebug/test-keys", t,
+		fmt.Sprintf("wrong fingerprint %q", h.Fingerprint))
+	assert(h.VolumeUuid == "", t, fmt.Sprintf("wrong volume uuid %q", h.VolumeUuid))
+
+	// no <version> element
+	db, err = pkg.OpenPackageDB("testdata/keyindex.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.Header() == pkg.Header{}, t, "expected zero header")
+}
+
+func TestDebug(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	tests := map[string]bool{
+		"com.android.providers.telephony": false,
+		"com.example.notes":               false,
+		"com.example.todo":                true,
+	}
+
+	for nm, dbg := range tests {
+		p := db.GetByName(nm)
+		assert(p != nil, t, fmt.Sprintf("can't find %s", nm))
+		assert(p.Debug == dbg, t, fmt.Sprintf("%s: wrong debug flag %v", nm, p.Debug))
+	}
+}
+
+func TestListColumns(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/columns.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	// 5 columns: no gid
+	p := db.GetByName("com.android.providers.telephony")
+	assert(p != nil, t, "can't find com.android.providers.telephony")
+	assert(p.SEinfo == "platform:privapp", t, fmt.Sprintf("wrong seinfo %q", p.SEinfo))
+	assert(len(p.Gid) == 0, t, fmt.Sprintf("unexpected gids %v", p.Gid))
+	assert(p.SEinfoUser == "", t, fmt.Sprintf("unexpected seinfo user %q", p.SEinfoUser))
+
+	// 6 columns
+	p = db.GetByName("com.example.notes")
+	assert(p != nil, t, "can't find com.example.notes")
+	assert(len(p.Gid) == 1 && p.Gid[0] == 3003, t, fmt.Sprintf("wrong gids %v", p.Gid))
+	assert(p.SEinfoUser == "", t, fmt.Sprintf("unexpected seinfo user %q", p.SEinfoUser))
+
+	// 7 columns
+	p = db.GetByName("com.example.todo")
+	assert(p != nil, t, "can't find com.example.todo")
+	assert(len(p.Gid) == 0, t, fmt.Sprintf("unexpected gids %v", p.Gid))
+	assert(p.SEinfoUser == "default:targetSdkVersion=28", t, fmt.Sprintf("wrong seinfo user %q", p.SEinfoUser))
+
+	_, err = pkg.OpenPackageDB("testdata/packages.xml", "testdata/short.list")
+	assert(err != nil, t, "short line parsed")
+}
+
+func TestAutoRefresh(t *testing.T) {
+	dir := copyFixtures(t, "packages.xml", "packages.list")
+	xml := filepath.Join(dir, "packages.xml")
+	list := filepath.Join(dir, "packages.list")
+
+	db, err := pkg.OpenPackageDB(xml, list)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	db.SetAutoRefresh(false)
+
+	// add a list-only package and make sure it's visibly newer
+	fd, err := os.OpenFile(list, os.O_APPEND|os.O_WRONLY, 0600)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	fmt.Fprintf(fd, "com.example.new 10052 0 /data/user/0/com.example.new default none\n")
+	fd.Close()
+
+	fut := time.Now().Add(time.Hour)
+	assert(os.Chtimes(list, fut, fut) == nil, t, "chtimes list")
+
+	assert(db.GetByName("com.example.new") == nil, t, "auto-refresh happened")
+
+	err = db.Refresh()
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.GetByName("com.example.new") != nil, t, "refresh didn't pick up new pkg")
+}
+
+func TestPartialDB(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/nonexistent.xml", "testdata/packages.list")
+	assert(errors.Is(err, pkg.ErrPartialDB), t, fmt.Sprintf("expected partial DB, saw %v", err))
+	assert(errors.Is(err, os.ErrNotExist), t, fmt.Sprintf("missing file error not wrapped: %v", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p != nil, t, "can't find com.example.notes")
+	assert(p.Uid == 10050, t, fmt.Sprintf("wrong uid %d", p.Uid))
+	assert(p.Cert == nil, t, "list-only pkg has a cert")
+
+	db, err = pkg.OpenPackageDB("testdata/packages.xml", "testdata/nonexistent.list")
+	assert(errors.Is(err, pkg.ErrPartialDB), t, fmt.Sprintf("expected partial DB, saw %v", err))
+
+	p = db.GetByName("com.example.notes")
+	assert(p != nil, t, "can't find com.example.notes")
+	assert(p.Cert != nil, t, "xml pkg has no cert")
+
+	_, err = pkg.OpenPackageDB("testdata/nonexistent.xml", "testdata/nonexistent.list")
+	assert(err != nil && !errors.Is(err, pkg.ErrPartialDB), t, fmt.Sprintf("expected hard error, saw %v", err))
+}
+
+func TestCodePath(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/codepath.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	tests := map[string]string{
+		"/data/app/com.example.notes-1":             "com.example.notes",
+		"/data/app/com.example.notes-1/":            "com.example.notes",
+		"/data/app/com.example.notes-1/base.apk":    "com.example.notes",
+		"/data/app/com.example.notes-1/split_a.apk": "com.example.notes",
+		"/data/app/com.example.todo-1.apk":          "com.example.todo",
+		"/data/app/com.example.nothere-1/base.apk":  "",
+		"/data/app/com.example.notes-1/lib/libx.so": "",
+	}
+
+	for fn, nm := range tests {
+		p := db.GetByCodePath(fn)
+		if nm == "" {
+			assert(p == nil, t, fmt.Sprintf("%s: unexpected match %s", fn, p))
+			continue
+		}
+		assert(p != nil, t, fmt.Sprintf("%s: no match", fn))
+		assert(p.Name == nm, t, fmt.Sprintf("%s: wrong match %s", fn, p.Name))
+	}
+}
+
+func TestCertHash(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/keyindex.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	a := db.GetByName("com.example.notes")
+	assert(a != nil && a.Cert != nil, t, "can't find com.example.notes")
+
+	pv := db.GetByCertHash(a.Certhash)
+	assert(len(pv) == 2, t, fmt.Sprintf("expected 2 pkgs, saw %d", len(pv)))
+
+	names := map[string]bool{}
+	for _, p := range pv {
+		names[p.Name] = true
+	}
+	assert(names["com.example.notes"] && names["com.example.todo"], t, fmt.Sprintf("wrong pkgs %v", names))
+
+	// list-only packages have no cert
+	assert(db.GetByCertHash(nil) == nil, t, "certless pkgs are indexed")
+}
+
+func TestRangeIterators(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	n := 0
+	for p := range db.Packages() {
+		assert(db.GetByName(p.Name) == p, t, fmt.Sprintf("%s: lookup mismatch", p.Name))
+		n++
+	}
+	assert(n >= 3, t, fmt.Sprintf("saw only %d pkgs", n))
+
+	for range db.Packages() {
+		break
+	}
+
+	for u, pv := range db.PackagesByUid() {
+		for _, p := range pv {
+			assert(p.Uid == u, t, fmt.Sprintf("%s: uid %d != %d", p.Name, p.Uid, u))
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	b, err := json.Marshal(db)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	b2, err := json.Marshal(db)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(bytes.Equal(b, b2), t, "JSON output is not stable")
+
+	var v struct {
+		Header struct {
+			SdkVersion int `json:"sdk_version"`
+		} `json:"header"`
+		Packages []map[string]any `json:"packages"`
+	}
+	err = json.Unmarshal(b, &v)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(v.Header.SdkVersion == 24, t, fmt.Sprintf("wrong sdk version %d", v.Header.SdkVersion))
+
+	// the calling process isn't a package
+	assert(len(v.Packages) == db.Len()-1, t, fmt.Sprintf("expected %d pkgs, saw %d", db.Len()-1, len(v.Packages)))
+
+	var prev string
+	var notes map[string]any
+	for _, p := range v.Packages {
+		nm := p["name"].(string)
+		assert(!strings.HasPrefix(nm, "caller-uid-"), t, fmt.Sprintf("wrote the pseudo pkg %s", nm))
+		assert(prev < nm, t, fmt.Sprintf("unsorted: %s after %s", nm, prev))
+		prev = nm
+		if nm == "com.example.notes" {
+			notes = p
+		}
+	}
+
+	assert(notes != nil, t, "can't find com.example.notes")
+	assert(notes["uid"].(float64) == 10050, t, fmt.Sprintf("wrong uid %v", notes["uid"]))
+	assert(notes["cert_cn"] == "William Huang", t, fmt.Sprintf("wrong cert CN %v", notes["cert_cn"]))
+
+	p := db.GetByName("com.example.notes")
+	assert(notes["certhash"] == hex.EncodeToString(p.Certhash), t, "wrong certhash")
+}
+
+func TestDiff(t *testing.T) {
+	const oldXML = `<packages>
+    <package name="com.example.a" codePath="/data/app/com.example.a-1" version="1" userId="10050" />
+    <package name="com.example.b" codePath="/data/app/com.example.b-1" version="1" userId="10051" />
+    <package name="com.example.c" codePath="/data/app/com.example.c-1" version="1" userId="10052" />
+</packages>`
+	const newXML = `<packages>
+    <package name="com.example.a" codePath="/data/app/com.example.a-1" version="1" userId="10050" />
+    <package name="com.example.c" codePath="/data/app/com.example.c-2" version="2" userId="10052" />
+    <package name="com.example.d" codePath="/data/app/com.example.d-1" version="1" userId="10053" />
+</packages>`
+
+	a, err := pkg.OpenPackageDBReader(strings.NewReader(oldXML), strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	b, err := pkg.OpenPackageDBReader(strings.NewReader(newXML), strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	d := b.Diff(a)
+	assert(len(d.Added) == 1 && d.Added[0].Name == "com.example.d", t, fmt.Sprintf("wrong added %v", d.Added))
+	assert(len(d.Removed) == 1 && d.Removed[0].Name == "com.example.b", t, fmt.Sprintf("wrong removed %v", d.Removed))
+	assert(len(d.Changed) == 1 && d.Changed[0].Name == "com.example.c", t, fmt.Sprintf("wrong changed %v", d.Changed))
+	assert(d.Changed[0].VersionCode == 2, t, "changed pkg is not from the new DB")
+
+	d = a.Diff(a)
+	assert(len(d.Added)+len(d.Removed)+len(d.Changed) == 0, t, "self diff is not empty")
+}
+
+func TestAccessors(t *testing.T) {
+	const xml = `<packages>
+    <package name="com.example.b" codePath="/data/app/com.example.b-1" userId="10051" />
+    <package name="com.example.a" codePath="/data/app/com.example.a-1" userId="10050" />
+    <package name="com.example.c" codePath="/data/app/com.example.c-1" sharedUserId="1000" />
+    <package name="android" codePath="/system/framework" sharedUserId="1000" />
+</packages>`
+
+	db, err := pkg.OpenPackageDBReader(strings.NewReader(xml), strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	// the caller may have been added as a pseudo package
+	self := 0
+	if db.GetByName(fmt.Sprintf("caller-uid-%d", os.Getuid())) != nil {
+		self = 1
+	}
+
+	assert(db.Len() == 4+self, t, fmt.Sprintf("wrong len %d", db.Len()))
+
+	names := db.Names()
+	assert(sort.StringsAreSorted(names), t, fmt.Sprintf("names not sorted: %v", names))
+	assert(len(names) == 4+self, t, fmt.Sprintf("wrong names %v", names))
+
+	uids := db.Uids()
+	assert(len(uids) == 3+self, t, fmt.Sprintf("wrong uids %v", uids))
+	for i := 1; i < len(uids); i++ {
+		assert(uids[i-1] < uids[i], t, fmt.Sprintf("uids not sorted: %v", uids))
+	}
+}
+
+func TestSEinfo(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/seinfo.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	tests := map[string]int{
+		"platform:privapp": 2,
+		"platform":         1,
+		"default":          2,
+		"none":             0,
+		"":                 0,
+	}
+
+	for se, n := range tests {
+		pv := db.GetBySEinfo(se)
+		assert(len(pv) == n, t, fmt.Sprintf("%q: expected %d pkgs, saw %d", se, n, len(pv)))
+		for _, p := range pv {
+			assert(p.SEinfo == se, t, fmt.Sprintf("%s: wrong seinfo %q", p.Name, p.SEinfo))
+		}
+	}
+}
+
+func TestListLineEndings(t *testing.T) {
+	const list = "com.example.notes 10050 0 /data/user/0/com.example.notes default 3003\r\n" +
+		"\r\n" +
+		"\n" +
+		"com.example.todo 10051 1 /data/user/0/com.example.todo default none"
+
+	db, err := pkg.OpenPackageDBReader(strings.NewReader("<packages/>"), strings.NewReader(list))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p != nil, t, "can't find com.example.notes")
+	assert(len(p.Gid) == 1 && p.Gid[0] == 3003, t, fmt.Sprintf("wrong gids %v", p.Gid))
+
+	p = db.GetByName("com.example.todo")
+	assert(p != nil, t, "can't find com.example.todo")
+	assert(p.SEinfo == "default", t, fmt.Sprintf("wrong seinfo %q", p.SEinfo))
+}
+
+func TestGzip(t *testing.T) {
+	a, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	b, err := pkg.OpenPackageDB("testdata/packages.xml.gz", "testdata/packages.list.gz")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	ja, err := json.Marshal(a)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	jb, err := json.Marshal(b)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(bytes.Equal(ja, jb), t, "plain and gzip DBs differ")
+
+	p := b.GetByName("com.example.notes")
+	assert(p != nil && p.Cert != nil, t, "can't find com.example.notes in gzip DB")
+}
+
+func TestFS(t *testing.T) {
+	xml, err := os.ReadFile("testdata/packages.xml")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	list, err := os.ReadFile("testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	now := time.Now()
+	fsys := fstest.MapFS{
+		"data/system/packages.xml":  &fstest.MapFile{Data: xml, ModTime: now.Add(-time.Hour)},
+		"data/system/packages.list": &fstest.MapFile{Data: list, ModTime: now.Add(-time.Hour)},
+	}
+
+	db, err := pkg.OpenPackageDBFS(fsys, "data/system/packages.xml", "data/system/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p != nil && p.Cert != nil, t, "can't find com.example.notes")
+	assert(db.GetByName("com.example.new") == nil, t, "unexpected com.example.new")
+
+	// MapFS supports Stat; a newer list must be picked up
+	nl := append(list, []byte("com.example.new 10052 0 /data/user/0/com.example.new default none\n")...)
+	fsys["data/system/packages.list"] = &fstest.MapFile{Data: nl, ModTime: now.Add(time.Hour)}
+	assert(db.GetByName("com.example.new") != nil, t, "refresh didn't pick up new pkg")
+
+	_, err = pkg.OpenPackageDBFS(fsys, "data/system/nope.xml", "data/system/nope.list")
+	assert(err != nil, t, "missing files opened")
+}
+
+func TestParseError(t *testing.T) {
+	const list = "com.example.notes 10050 0 /data/user/0/com.example.notes default 3003\n" +
+		"\n" +
+		"com.example.todo 1005x 1 /data/user/0/com.example.todo default none\n"
+
+	_, err := pkg.OpenPackageDBReader(strings.NewReader("<packages/>"), strings.NewReader(list))
+
+	var pe *pkg.ParseError
+	assert(errors.As(err, &pe), t, fmt.Sprintf("not a ParseError: %v", err))
+	assert(pe.File == "packages.list", t, fmt.Sprintf("wrong file %q", pe.File))
+	assert(pe.Line == 3, t, fmt.Sprintf("wrong line %d", pe.Line))
+	assert(pe.Package == "com.example.todo", t, fmt.Sprintf("wrong pkg %q", pe.Package))
+	assert(errors.Is(err, strconv.ErrSyntax), t, fmt.Sprintf("cause not wrapped: %v", err))
+
+	_, err = pkg.OpenPackageDB("testdata/badtime.xml", "testdata/packages.list")
+	assert(errors.As(err, &pe), t, fmt.Sprintf("not a ParseError: %v", err))
+	assert(pe.File == "testdata/badtime.xml", t, fmt.Sprintf("wrong file %q", pe.File))
+	assert(pe.Package == "com.example.todo", t, fmt.Sprintf("wrong pkg %q", pe.Package))
+
+	_, err = pkg.OpenPackageDBReader(strings.NewReader("<packages><package"), strings.NewReader(""))
+	assert(errors.As(err, &pe), t, fmt.Sprintf("not a ParseError: %v", err))
+}
+
+func TestLenient(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "packages.list")
+	err := os.WriteFile(list, []byte(
+		"com.example.notes 10050 0 /data/user/0/com.example.notes default 3003\n"+
+			"com.example.bad 1005x 0 /data/user/0/com.example.bad default none\n"+
+			"com.example.todo 10051 1 /data/user/0/com.example.todo default none\n"), 0600)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	_, err = pkg.OpenPackageDBStrict("testdata/packages.xml", list, true)
+	assert(err != nil, t, "strict mode accepted a malformed line")
+
+	db, err := pkg.OpenPackageDBStrict("testdata/packages.xml", list, false)
+	assert(err != nil, t, "lenient mode lost the error")
+
+	var pe *pkg.ParseError
+	assert(errors.As(err, &pe), t, fmt.Sprintf("not a ParseError: %v", err))
+	assert(pe.Line == 2 && pe.Package == "com.example.bad", t, fmt.Sprintf("wrong error %v", pe))
+
+	assert(db.GetByName("com.example.notes") != nil, t, "lost com.example.notes")
+	assert(db.GetByName("com.example.todo") != nil, t, "lost com.example.todo")
+	assert(db.GetByName("com.example.bad") == nil, t, "kept com.example.bad")
+}
+
+func TestWithStrict(t *testing.T) {
+	list := "com.example.notes 10050 0 /data/user/0/com.example.notes default 3003\n" +
+		"com.example.bad 1005x 0 /data/user/0/com.example.bad default none\n"
+	fn := filepath.Join(t.TempDir(), "packages.list")
+	assert(os.WriteFile(fn, []byte(list), 0600) == nil, t, "write list")
+
+	check := func(db *pkg.PackageDB, err error) {
+		var pe *pkg.ParseError
+		assert(errors.As(err, &pe), t, fmt.Sprintf("lenient mode lost the error: %v", err))
+		assert(pe.Line == 2 && pe.Package == "com.example.bad", t, fmt.Sprintf("wrong error %v", pe))
+		assert(db.GetByName("com.example.notes") != nil, t, "lost com.example.notes")
+		assert(db.GetByName("com.example.bad") == nil, t, "kept com.example.bad")
+	}
+
+	_, err := pkg.OpenPackageDB("testdata/packages.xml", fn)
+	assert(err != nil, t, "strict mode accepted a malformed line")
+	check(pkg.OpenPackageDB("testdata/packages.xml", fn, pkg.WithStrict(false)))
+
+	// the option overrides the argument
+	_, err = pkg.OpenPackageDBStrict("testdata/packages.xml", fn, false, pkg.WithStrict(true))
+	assert(err != nil, t, "WithStrict(true) didn't override")
+
+	xml, err := os.ReadFile("testdata/packages.xml")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	_, err = pkg.OpenPackageDBReader(bytes.NewReader(xml), strings.NewReader(list))
+	assert(err != nil, t, "strict mode accepted a malformed line")
+	check(pkg.OpenPackageDBReader(bytes.NewReader(xml), strings.NewReader(list), pkg.WithStrict(false)))
+
+	// the malformed packages in packages.xml are reported too
+	bad := `<packages><package name="com.example.bad" codePath="/data/app/com.example.bad-1" userId="1005x" /></packages>`
+	db, err := pkg.OpenPackageDBReader(strings.NewReader(bad), strings.NewReader(""), pkg.WithStrict(false))
+	var pe *pkg.ParseError
+	assert(errors.As(err, &pe) && pe.File == "packages.xml" && strings.Contains(err.Error(), "1005x"), t,
+		fmt.Sprintf("wrong error %v", err))
+	assert(db.GetByName("com.example.bad") == nil, t, "kept a package with a bad uid")
+}
+
+func TestNoUid(t *testing.T) {
+	xml, list := "testdata/nouid.xml", "testdata/packages.list"
+
+	_, err := pkg.OpenPackageDBStrict(xml, list, true)
+	var pe *pkg.ParseError
+	assert(errors.As(err, &pe), t, fmt.Sprintf("strict mode accepted a package without a uid: %v", err))
+	assert(errors.Is(err, pkg.ErrNoUid), t, fmt.Sprintf("wrong error %v", err))
+	assert(pe.Package == "com.android.theme.icon.round", t, fmt.Sprintf("wrong package %q", pe.Package))
+
+	db, err := pkg.OpenPackageDBStrict(xml, list, false)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.GetByName("com.android.theme.icon.round") == nil, t, "kept package without a uid")
+	assert(db.GetByName("com.example.notes").Path == "/data/app/com.example.notes-1", t, "lost com.example.notes")
+	assert(db.GetByName("com.example.todo").Path == "/data/app/com.example.todo-1", t, "lost com.example.todo")
+
+	w := db.Warnings()
+	assert(len(w) == 1 && strings.Contains(w[0], "com.android.theme.icon.round"), t,
+		fmt.Sprintf("wrong warnings %q", w))
+}
+
+func TestWatch(t *testing.T) {
+	dir := copyFixtures(t, "packages.xml", "packages.list")
+	xml := filepath.Join(dir, "packages.xml")
+	list := filepath.Join(dir, "packages.list")
+
+	db, err := pkg.OpenPackageDB(xml, list)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	db.SetAutoRefresh(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := db.Watch(ctx)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	// rewrite the list the way Android does: write a new file and
+	// rename it into place
+	b, err := os.ReadFile(list)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	b = append(b, []byte("com.example.new 10052 0 /data/user/0/com.example.new default none\n")...)
+
+	tmp := filepath.Join(dir, "packages.list.tmp")
+	assert(os.WriteFile(tmp, b, 0600) == nil, t, "write tmp list")
+	fut := time.Now().Add(time.Hour)
+	assert(os.Chtimes(tmp, fut, fut) == nil, t, "chtimes tmp list")
+	assert(os.Rename(tmp, list) == nil, t, "rename list")
+
+	select {
+	case <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no change notification")
+	}
+	assert(db.GetByName("com.example.new") != nil, t, "watch didn't reload")
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestWithoutSelf(t *testing.T) {
+	uid := uint32(os.Getuid())
+
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list", pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.GetByName(fmt.Sprintf("caller-uid-%v", uid)) == nil, t, "caller was added")
+	assert(db.Len() == 3, t, fmt.Sprintf("wrong len %d", db.Len()))
+}
+
+func TestCertHash256(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/keyindex.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p != nil && p.Cert != nil, t, "can't find com.example.notes")
+
+	// sha1sum and sha256sum of the DER cert
+	assert(hex.EncodeToString(p.Certhash) == "c3db860f3d9d9c80351ebef124b4375296c36e98", t,
+		fmt.Sprintf("wrong sha1 %x", p.Certhash))
+	assert(hex.EncodeToString(p.Certhash256) == "437640817fd96130b1040d9e4b803171bafc460073d2d7d431dd132d2cfa8f7a", t,
+		fmt.Sprintf("wrong sha256 %x", p.Certhash256))
+
+	pv := db.GetByCertHash256(p.Certhash256)
+	assert(len(pv) == 2, t, fmt.Sprintf("expected 2 pkgs, saw %d", len(pv)))
+}
+
+func TestSharedUsers(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/shared.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	assert(db.GetSharedUserName(1000) == "android.uid.system", t, fmt.Sprintf("wrong name %q", db.GetSharedUserName(1000)))
+	assert(db.GetSharedUserName(1001) == "android.uid.phone", t, fmt.Sprintf("wrong name %q", db.GetSharedUserName(1001)))
+	assert(db.GetSharedUserName(10050) == "", t, "app uid is a shared user")
+
+	su := db.ListSharedUsers()
+	assert(len(su) == 2 && su[0] == "android.uid.phone" && su[1] == "android.uid.system", t, fmt.Sprintf("wrong shared users %v", su))
+
+	assert(len(db.GetListByUid(1000)) == 2, t, "expected 2 pkgs in android.uid.system")
+}
+
+func TestCertExpiry(t *testing.T) {
+	now := time.Now()
+	old := mkcert(t, "expired", now.AddDate(-2, 0, 0), now.AddDate(-1, 0, 0))
+	cur := mkcert(t, "current", now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0))
+
+	xml := fmt.Sprintf(`<packages>
+    <package name="com.example.old" codePath="/data/app/com.example.old-1" userId="10050">
+        <sigs count="1"><cert index="0" key="%x" /></sigs>
+    </package>
+    <package name="com.example.cur" codePath="/data/app/com.example.cur-1" userId="10051">
+        <sigs count="1"><cert index="1" key="%x" /></sigs>
+    </package>
+    <package name="com.example.none" codePath="/data/app/com.example.none-1" userId="10052" />
+</packages>`, old, cur)
+
+	db, err := pkg.OpenPackageDBReader(strings.NewReader(xml), strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.old")
+	assert(p.CertExpired(now), t, "expired cert is valid")
+	assert(p.CertValidityRemaining(now) == 0, t, "expired cert has validity left")
+
+	p = db.GetByName("com.example.cur")
+	assert(!p.CertExpired(now), t, "current cert is expired")
+	assert(p.CertExpired(now.AddDate(-3, 0, 0)), t, "not-yet-valid cert is valid")
+	assert(p.CertValidityRemaining(now) > 360*24*time.Hour, t, "wrong validity")
+
+	p = db.GetByName("com.example.none")
+	assert(!p.CertExpired(now), t, "certless pkg is expired")
+	assert(p.CertValidityRemaining(now) == 0, t, "certless pkg has validity")
+
+	pv := db.ExpiredCerts(now)
+	assert(len(pv) == 1 && pv[0].Name == "com.example.old", t, fmt.Sprintf("wrong expired list %v", pv))
+}
+
+func TestSameSigner(t *testing.T) {
+	now := time.Now()
+	k1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	k2, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	// same key, different serial and subject
+	a := mkcertKey(t, k1, 1, pkix.Name{CommonName: "dev"}, now, now.AddDate(1, 0, 0))
+	b := mkcertKey(t, k1, 2, pkix.Name{CommonName: "dev 2"}, now, now.AddDate(2, 0, 0))
+	c := mkcertKey(t, k2, 1, pkix.Name{CommonName: "other"}, now, now.AddDate(1, 0, 0))
+
+	xml := fmt.Sprintf(`<packages>
+    <package name="com.example.a" codePath="/data/app/com.example.a-1" userId="10050">
+        <sigs count="1"><cert index="0" key="%x" /></sigs>
+    </package>
+    <package name="com.example.b" codePath="/data/app/com.example.b-1" userId="10051">
+        <sigs count="1"><cert index="1" key="%x" /></sigs>
+    </package>
+    <package name="com.example.c" codePath="/data/app/com.example.c-1" userId="10052">
+        <sigs count="1"><cert index="2" key="%x" /></sigs>
+    </package>
+    <package name="com.example.d" codePath="/data/app/com.example.d-1" userId="10053" />
+</packages>`, a, b, c)
+
+	db, err := pkg.OpenPackageDBReader(strings.NewReader(xml), strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	pa := db.GetByName("com.example.a")
+	pb := db.GetByName("com.example.b")
+	pc := db.GetByName("com.example.c")
+	pd := db.GetByName("com.example.d")
+
+	assert(pa.SameSigner(pb), t, "a and b have different signers")
+	assert(!pa.SameSigner(pc), t, "a and c have the same signer")
+	assert(!pa.SameSigner(pd), t, "a and certless d have the same signer")
+	assert(!pd.SameSigner(pd), t, "certless pkg has a signer")
+
+	g := db.GroupBySigner()
+	assert(len(g) == 2, t, fmt.Sprintf("expected 2 groups, saw %d", len(g)))
+	for _, pv := range g {
+		switch len(pv) {
+		case 1:
+			assert(pv[0] == pc, t, "wrong singleton group")
+		case 2:
+			assert(pv[0] == pa && pv[1] == pb, t, "wrong pair group")
+		default:
+			t.Fatalf("unexpected group %v", pv)
+		}
+	}
+}
+
+func TestUserRestrictions(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	err = db.LoadUserRestrictions(10, "testdata/package-restrictions.xml")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	notes := db.GetByName("com.example.notes")
+	todo := db.GetByName("com.example.todo")
+	tel := db.GetByName("com.android.providers.telephony")
+
+	assert(!notes.EnabledForUser(10), t, "disabled pkg is enabled")
+	assert(!todo.EnabledForUser(10), t, "hidden pkg is enabled")
+	assert(tel.EnabledForUser(10), t, "stopped pkg is disabled")
+
+	st, ok := todo.UserState(10)
+	assert(ok && st.Hidden, t, fmt.Sprintf("wrong state %+v", st))
+
+	// users without restrictions get the default
+	assert(notes.EnabledForUser(0), t, "pkg disabled for unknown user")
+	_, ok = notes.UserState(0)
+	assert(!ok, t, "unknown user has state")
+
+	// and the state survives a refresh
+	err = db.Refresh()
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(!db.GetByName("com.example.notes").EnabledForUser(10), t, "state lost in refresh")
+}
+
+func TestComponents(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/components.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p.Enabled, t, "com.example.notes is disabled")
+	assert(len(p.DisabledComponents) == 2, t, fmt.Sprintf("wrong disabled components %v", p.DisabledComponents))
+	assert(p.DisabledComponents[0] == "com.example.notes.SyncService", t, "wrong disabled component")
+	assert(len(p.EnabledComponents) == 1 && p.EnabledComponents[0] == "com.example.notes.ShareActivity", t,
+		fmt.Sprintf("wrong enabled components %v", p.EnabledComponents))
+
+	p = db.GetByName("com.example.todo")
+	assert(!p.Enabled, t, "com.example.todo is enabled")
+	assert(p.DisabledComponents == nil && p.EnabledComponents == nil, t, "unexpected components")
+
+	p = db.GetByName("com.example.calc")
+	assert(p.Enabled, t, "com.example.calc is disabled")
+}
+
+func TestNativeABI(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p.NativeLibraryPath == "/data/app/com.example.notes-1/lib", t, fmt.Sprintf("wrong path %q", p.NativeLibraryPath))
+	assert(p.NativeABI() == "", t, fmt.Sprintf("unexpected abi %q", p.NativeABI()))
+
+	tests := map[string]string{
+		"/data/app/com.foo-1/lib/arm64":        "arm64",
+		"/data/app/com.foo-1/lib/armeabi-v7a/": "armeabi-v7a",
+		"/data/app-lib/com.foo-1":              "",
+		"":                                     "",
+	}
+	for np, abi := range tests {
+		p := &pkg.Pkg{NativeLibraryPath: np}
+		assert(p.NativeABI() == abi, t, fmt.Sprintf("%q: wrong abi %q", np, p.NativeABI()))
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := copyFixtures(t, "packages.xml", "packages.list")
+	xml := filepath.Join(dir, "packages.xml")
+	list := filepath.Join(dir, "packages.list")
+
+	db, err := pkg.OpenPackageDB(xml, list)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	snap := db.Snapshot()
+	assert(snap.Len() == db.Len(), t, "snapshot has a different size")
+	assert(snap.Header() == db.Header(), t, "snapshot has a different header")
+
+	a := db.GetByName("com.example.notes")
+	b := snap.GetByName("com.example.notes")
+	assert(a != b, t, "snapshot shares Pkg values")
+	assert(bytes.Equal(a.Certhash, b.Certhash), t, "snapshot has different cert hash")
+	assert(len(snap.GetByCertHash(a.Certhash)) == 1, t, "snapshot isn't indexed")
+
+	b.Gid[0] = 1
+	assert(a.Gid[0] == 3003, t, "snapshot shares gids")
+
+	// changes to the backing files don't show up in the snapshot
+	fd, err := os.OpenFile(list, os.O_APPEND|os.O_WRONLY, 0600)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	fmt.Fprintf(fd, "com.example.new 10052 0 /data/user/0/com.example.new default none\n")
+	fd.Close()
+
+	fut := time.Now().Add(time.Hour)
+	assert(os.Chtimes(list, fut, fut) == nil, t, "chtimes list")
+
+	assert(db.GetByName("com.example.new") != nil, t, "DB didn't refresh")
+	assert(snap.GetByName("com.example.new") == nil, t, "snapshot changed")
+	assert(snap.Refresh() == nil, t, "snapshot refresh failed")
+	assert(snap.GetByName("com.example.new") == nil, t, "snapshot changed")
+}
+
+func TestWriteList(t *testing.T) {
+	db, err := pkg.OpenPackageDB("../packages.xml", "../packages.list", pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	var b bytes.Buffer
+	err = db.WriteList(&b)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	xml := strings.NewReader("<packages/>")
+	db2, err := pkg.OpenPackageDBReader(xml, &b, pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db2.Len() == 85, t, fmt.Sprintf("expected 85 pkgs, saw %d", db2.Len()))
+
+	for p := range db2.Packages() {
+		a := db.GetByName(p.Name)
+		assert(a != nil, t, fmt.Sprintf("%s: missing", p.Name))
+		assert(a.Uid == p.Uid, t, fmt.Sprintf("%s: uid mismatch", p.Name))
+		assert(a.Debug == p.Debug, t, fmt.Sprintf("%s: debug mismatch", p.Name))
+		assert(a.DataPath == p.DataPath, t, fmt.Sprintf("%s: datapath mismatch", p.Name))
+		assert(a.SEinfo == p.SEinfo, t, fmt.Sprintf("%s: seinfo mismatch", p.Name))
+		assert(a.SEinfoUser == p.SEinfoUser, t, fmt.Sprintf("%s: seinfo user mismatch", p.Name))
+		assert(fmt.Sprint(a.Gid) == fmt.Sprint(p.Gid), t, fmt.Sprintf("%s: gid mismatch", p.Name))
+	}
+
+	// and the output is exactly what we started with (modulo order)
+	want, err := os.ReadFile("../packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	b.Reset()
+	db2.WriteList(&b)
+	wl := strings.Split(strings.TrimSpace(string(want)), "\n")
+	gl := strings.Split(strings.TrimSpace(b.String()), "\n")
+	sort.Strings(wl)
+	assert(slices.Equal(wl, gl), t, "list output differs from input")
+}
+
+func TestWriteXML(t *testing.T) {
+	db, err := pkg.OpenPackageDB("../packages.xml", "../packages.list", pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	var b bytes.Buffer
+	err = db.WriteXML(&b)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	db2, err := pkg.OpenPackageDBReader(&b, strings.NewReader(""), pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db2.Len() == db.Len(), t, fmt.Sprintf("expected %d pkgs, saw %d", db.Len(), db2.Len()))
+	assert(db2.Header() == db.Header(), t, "header mismatch")
+	assert(slices.Equal(db2.ListSharedUsers(), db.ListSharedUsers()), t, "shared users mismatch")
+
+	for p := range db2.Packages() {
+		a := db.GetByName(p.Name)
+		assert(a != nil, t, fmt.Sprintf("%s: missing", p.Name))
+		assert(a.Uid == p.Uid, t, fmt.Sprintf("%s: uid mismatch", p.Name))
+		assert(a.SharedUid == p.SharedUid, t, fmt.Sprintf("%s: shared uid mismatch", p.Name))
+		assert(a.Path == p.Path, t, fmt.Sprintf("%s: path mismatch", p.Name))
+		assert(a.Installer == p.Installer, t, fmt.Sprintf("%s: installer mismatch", p.Name))
+		assert(a.Version == p.Version, t, fmt.Sprintf("%s: version mismatch", p.Name))
+		assert(a.VersionCode == p.VersionCode, t, fmt.Sprintf("%s: version code mismatch", p.Name))
+		assert(a.Flags == p.Flags, t, fmt.Sprintf("%s: flags mismatch", p.Name))
+		assert(a.FirstInstallTime.Equal(p.FirstInstallTime), t, fmt.Sprintf("%s: install time mismatch", p.Name))
+		assert(a.LastUpdateTime.Equal(p.LastUpdateTime), t, fmt.Sprintf("%s: update time mismatch", p.Name))
+		assert(bytes.Equal(a.Certhash, p.Certhash), t, fmt.Sprintf("%s: certhash mismatch", p.Name))
+		assert(bytes.Equal(a.Certhash256, p.Certhash256), t, fmt.Sprintf("%s: certhash256 mismatch", p.Name))
+		assert(slices.Equal(a.Permissions, p.Permissions), t, fmt.Sprintf("%s: permissions mismatch", p.Name))
+		assert(len(a.Certs) == len(p.Certs), t, fmt.Sprintf("%s: cert count mismatch", p.Name))
+		for i := range a.Certs {
+			assert(bytes.Equal(a.Certs[i].Raw, p.Certs[i].Raw), t, fmt.Sprintf("%s: cert %d mismatch", p.Name, i))
+		}
+	}
+}
+
+func TestWriteXMLEnabled(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/enabled.xml", "testdata/packages.list", pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	var b bytes.Buffer
+	assert(db.WriteXML(&b) == nil, t, "write xml failed")
+	db2, err := pkg.OpenPackageDBReader(bytes.NewReader(b.Bytes()), strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	tests := []struct {
+		name    string
+		enabled bool
+		attr    string
+	}{
+		{"com.example.default", true, ""},
+		{"com.example.enabled", true, ` enabled="1"`},
+		{"com.example.disabled", false, ` enabled="2"`},
+		{"com.example.user", false, ` enabled="3"`},
+		{"com.example.unused", false, ` enabled="4"`},
+		{"com.example.old", false, ` enabled="2"`},
+	}
+
+	for _, x := range tests {
+		assert(db2.GetByName(x.name).Enabled == x.enabled, t, fmt.Sprintf("%s: wrong enabled", x.name))
+		want := fmt.Sprintf(`name="%s"`, x.name)
+		i := bytes.Index(b.Bytes(), []byte(want))
+		assert(i > 0, t, fmt.Sprintf("%s: not written", x.name))
+		line, _, _ := bytes.Cut(b.Bytes()[i:], []byte(">"))
+		assert(strings.Contains(string(line), ` enabled=`) == (len(x.attr) > 0), t,
+			fmt.Sprintf("%s: wrong enabled in %q", x.name, line))
+		assert(strings.Contains(string(line), x.attr), t, fmt.Sprintf("%s: wrong enabled in %q", x.name, line))
+	}
+}
+
+func TestOpenContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	db, err := pkg.OpenPackageDBContext(ctx, "../packages.xml", "../packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.GetByName("com.android.shell") != nil, t, "can't find com.android.shell")
+
+	cancel()
+	db, err = pkg.OpenPackageDBContext(ctx, "../packages.xml", "../packages.list")
+	assert(errors.Is(err, context.Canceled), t, fmt.Sprintf("expected context.Canceled, saw %v", err))
+	assert(db == nil, t, "expected nil DB on cancel")
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, err = pkg.OpenPackageDBContext(ctx, "../packages.xml", "../packages.list")
+	assert(errors.Is(err, context.DeadlineExceeded), t, fmt.Sprintf("expected deadline, saw %v", err))
+}
+
+func TestPermissions(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/perms.xml", "testdata/packages.list", pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p != nil, t, "can't find com.example.notes")
+	want := []string{"android.permission.INTERNET", "android.permission.WAKE_LOCK"}
+	assert(slices.Equal(p.Permissions, want), t, fmt.Sprintf("wrong perms %v", p.Permissions))
+
+	p = db.GetByName("com.example.calc")
+	assert(p != nil, t, "can't find com.example.calc")
+	assert(p.Permissions == nil, t, fmt.Sprintf("expected no perms, saw %v", p.Permissions))
+
+	pv := db.GetByPermission("android.permission.INTERNET")
+	assert(len(pv) == 2, t, fmt.Sprintf("expected 2 pkgs with INTERNET, saw %d", len(pv)))
+	assert(len(db.GetByPermission("android.permission.READ_CONTACTS")) == 0, t, "revoked perm is indexed")
+	assert(db.GetByPermission("android.permission.CAMERA") == nil, t, "unknown perm has pkgs")
+
+	// files that lack <perms> entirely
+	db, err = pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	for p := range db.Packages() {
+		assert(p.Permissions == nil, t, fmt.Sprintf("%s: unexpected perms", p.Name))
+	}
+
+	db, err = pkg.OpenPackageDB("../packages.xml", "../packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	pv = db.GetByPermission("android.permission.WRITE_SETTINGS")
+	assert(len(pv) > 0, t, "no pkgs with WRITE_SETTINGS")
+}
+
+func TestDuplicateList(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/dup.list", pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	pv := db.GetListByUid(10052)
+	assert(len(pv) == 1, t, fmt.Sprintf("expected 1 pkg for uid 10052, saw %d", len(pv)))
+	assert(pv[0].DataPath == "/data/user/0/com.example.new.2", t, fmt.Sprintf("wrong datapath %q", pv[0].DataPath))
+
+	w := db.Warnings()
+	assert(len(w) == 1, t, fmt.Sprintf("expected 1 warning, saw %d", len(w)))
+	assert(strings.Contains(w[0], "com.example.new"), t, fmt.Sprintf("wrong warning %q", w[0]))
+
+	db, err = pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(db.Warnings()) == 0, t, "unexpected warnings")
+}
+
+func TestUidOrder(t *testing.T) {
+	db, err := pkg.OpenPackageDB("../packages.xml", "../packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	names := func() []string {
+		var v []string
+		for _, p := range db.GetListByUid(1001) {
+			v = append(v, p.Name)
+		}
+		return v
+	}
+
+	want := names()
+	assert(len(want) > 1, t, fmt.Sprintf("expected several pkgs for uid 1001, saw %d", len(want)))
+	assert(sort.StringsAreSorted(want), t, fmt.Sprintf("uid 1001 pkgs not sorted: %v", want))
+	assert(len(slices.Compact(slices.Clone(want))) == len(want), t, "duplicate pkgs for uid 1001")
+
+	for range 10 {
+		assert(db.Refresh() == nil, t, "refresh failed")
+		assert(slices.Equal(names(), want), t, "uid 1001 pkgs changed order")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	db, err := pkg.OpenPackageDB("../packages.xml", "../packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	err = db.Validate()
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	db, err = pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.Validate() == nil, t, "testdata DB is invalid")
+
+	p := db.GetByName("com.example.notes")
+	p.Certhash[0] ^= 0xff
+	p.Uid = 0
+
+	err = db.Validate()
+	assert(err != nil, t, "tampered DB is valid")
+	assert(strings.Contains(err.Error(), "uid is zero"), t, fmt.Sprintf("missing uid error: %s", err))
+	assert(strings.Contains(err.Error(), "doesn't match its hash"), t, fmt.Sprintf("missing hash error: %s", err))
+
+	db, err = pkg.OpenPackageDB("testdata/dupcode.xml", "testdata/packages.list", pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	err = db.Validate()
+	assert(err != nil, t, "duplicate code path DB is valid")
+	assert(strings.Contains(err.Error(), "also used by com.example.notes"), t, fmt.Sprintf("missing code path error: %s", err))
+}
+
+func TestUidRange(t *testing.T) {
+	list := `com.example.notes 10050 0 /data/user/0/com.example.notes default 3003
+com.example.todo 10051 1 /data/user/0/com.example.todo default none
+com.example.b 10002 0 /data/user/0/com.example.b default none
+com.example.a 10002 0 /data/user/0/com.example.a default none
+com.android.phone 1001 0 /data/user_de/0/com.android.phone platform none
+com.example.isolated 99001 0 /data/user/0/com.example.isolated default none
+`
+	db, err := pkg.OpenPackageDBReader(strings.NewReader("<packages/>"), strings.NewReader(list), pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	var names []string
+	for _, p := range db.GetByUidRange(10000, 19999) {
+		names = append(names, p.Name)
+	}
+	want := []string{"com.example.a", "com.example.b", "com.example.notes", "com.example.todo"}
+	assert(slices.Equal(names, want), t, fmt.Sprintf("wrong pkgs in range: %v", names))
+
+	assert(len(db.GetByUidRange(99000, 99999)) == 1, t, "can't find isolated uid")
+	assert(len(db.GetByUidRange(1001, 1001)) == 1, t, "can't find uid 1001")
+	assert(db.GetByUidRange(20000, 30000) == nil, t, "empty range has pkgs")
+}
+
+func TestUserID(t *testing.T) {
+	list := `com.example.notes 10050 0 /data/user/0/com.example.notes default 3003
+com.example.notes.work 1010050 0 /data/user/10/com.example.notes default 3003
+com.example.todo 1010234 0 /data/user/10/com.example.todo default none
+`
+	db, err := pkg.OpenPackageDBReader(strings.NewReader("<packages/>"), strings.NewReader(list), pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.todo")
+	assert(p != nil, t, "can't find com.example.todo")
+	assert(p.UserID() == 10, t, fmt.Sprintf("wrong user id %d", p.UserID()))
+	assert(p.AppID() == 10234, t, fmt.Sprintf("wrong app id %d", p.AppID()))
+
+	p = db.GetByName("com.example.notes")
+	assert(p.UserID() == 0, t, fmt.Sprintf("wrong user id %d", p.UserID()))
+	assert(p.AppID() == 10050, t, fmt.Sprintf("wrong app id %d", p.AppID()))
+
+	pv := db.GetByUserID(10)
+	assert(len(pv) == 2, t, fmt.Sprintf("expected 2 pkgs for user 10, saw %d", len(pv)))
+	assert(pv[0].Name == "com.example.notes.work", t, fmt.Sprintf("wrong order: %s", pv[0].Name))
+	assert(len(db.GetByUserID(0)) == 1, t, "expected 1 pkg for user 0")
+	assert(db.GetByUserID(11) == nil, t, "unexpected pkgs for user 11")
+	assert(db.GetByUserID(-1) == nil, t, "unexpected pkgs for user -1")
+}
+
+func TestSharedUid(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.android.providers.telephony")
+	assert(p != nil, t, "can't find telephony")
+	assert(p.IsShared(), t, "telephony isn't shared")
+	assert(p.SharedUid == 1001, t, fmt.Sprintf("wrong shared uid %d", p.SharedUid))
+	assert(p.Uid == 1001, t, fmt.Sprintf("wrong uid %d", p.Uid))
+
+	p = db.GetByName("com.example.notes")
+	assert(p != nil, t, "can't find com.example.notes")
+	assert(!p.IsShared(), t, "notes is shared")
+	assert(p.SharedUid == 0, t, fmt.Sprintf("wrong shared uid %d", p.SharedUid))
+	assert(p.Uid == 10050, t, fmt.Sprintf("wrong uid %d", p.Uid))
+}
+
+func TestFind(t *testing.T) {
+	db, err := pkg.OpenPackageDB("../packages.xml", "../packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	pv := db.FindByPrefix("com.android.providers.")
+	assert(len(pv) > 1, t, fmt.Sprintf("expected several providers, saw %d", len(pv)))
+	for i, p := range pv {
+		assert(strings.HasPrefix(p.Name, "com.android.providers."), t, fmt.Sprintf("%s: wrong prefix", p.Name))
+		assert(i == 0 || pv[i-1].Name < p.Name, t, "prefix matches not sorted")
+	}
+	assert(db.FindByPrefix("org.nonexistent.") == nil, t, "unexpected prefix matches")
+
+	pv, err = db.FindByGlob("com.android.*.telephony")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(pv) == 1, t, fmt.Sprintf("expected 1 glob match, saw %d", len(pv)))
+	assert(pv[0].Name == "com.android.providers.telephony", t, fmt.Sprintf("wrong glob match %s", pv[0].Name))
+
+	pv, err = db.FindByGlob("*.shell")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(pv) == 1, t, fmt.Sprintf("expected 1 glob match, saw %d", len(pv)))
+
+	_, err = db.FindByGlob("com.[android")
+	assert(errors.Is(err, path.ErrBadPattern), t, fmt.Sprintf("expected bad pattern, saw %v", err))
+}
+
+func TestCertCache(t *testing.T) {
+	dir := copyFixtures(t, "packages.xml", "packages.list")
+	xml := filepath.Join(dir, "packages.xml")
+	list := filepath.Join(dir, "packages.list")
+
+	db, err := pkg.OpenPackageDB(xml, list)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	a := db.GetByName("com.example.notes")
+	assert(a != nil && a.Cert != nil, t, "no cert for com.example.notes")
+
+	fut := time.Now().Add(time.Hour)
+	assert(os.Chtimes(xml, fut, fut) == nil, t, "chtimes xml")
+
+	b := db.GetByName("com.example.notes")
+	assert(a != b, t, "DB didn't refresh")
+	assert(a.Cert == b.Cert, t, "cert was parsed again")
+	assert(bytes.Equal(a.Certhash, b.Certhash), t, "cert hash changed")
+}
+
+func TestLookupErrors(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p, err := db.GetByNameE("com.example.notes")
+	assert(err == nil && p != nil, t, fmt.Sprintf("can't find com.example.notes: %v", err))
+	p, err = db.GetByUidE(10050)
+	assert(err == nil && p.Name == "com.example.notes", t, fmt.Sprintf("can't find uid 10050: %v", err))
+
+	_, err = db.GetByNameE("com.example.missing")
+	assert(errors.Is(err, pkg.ErrNotFound), t, fmt.Sprintf("expected not found, saw %v", err))
+	assert(strings.Contains(err.Error(), "com.example.missing"), t, fmt.Sprintf("error lacks name: %s", err))
+	_, err = db.GetByUidE(12345)
+	assert(errors.Is(err, pkg.ErrNotFound), t, fmt.Sprintf("expected not found, saw %v", err))
+
+	db.Close()
+	_, err = db.GetByNameE("com.example.notes")
+	assert(errors.Is(err, pkg.ErrDBEmpty), t, fmt.Sprintf("expected empty DB, saw %v", err))
+	_, err = db.GetByUidE(10050)
+	assert(errors.Is(err, pkg.ErrDBEmpty), t, fmt.Sprintf("expected empty DB, saw %v", err))
+}
+
+func TestRefreshErrors(t *testing.T) {
+	dir := copyFixtures(t, "packages.xml", "packages.list")
+	xml := filepath.Join(dir, "packages.xml")
+	list := filepath.Join(dir, "packages.list")
+	bad := filepath.Join(dir, "bad")
+
+	err := os.WriteFile(bad, []byte("com.example.bad notanumber 0 /data/user/0/com.example.bad default none\n"), 0600)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	// bad list, good xml
+	_, err = pkg.OpenPackageDB(xml, bad)
+	var pe *pkg.ParseError
+	assert(errors.As(err, &pe), t, fmt.Sprintf("expected parse error, saw %v", err))
+	assert(pe.File == bad, t, fmt.Sprintf("wrong file %s", pe.File))
+
+	// good list, bad xml
+	_, err = pkg.OpenPackageDB(bad, list)
+	assert(errors.As(err, &pe), t, fmt.Sprintf("expected parse error, saw %v", err))
+	assert(pe.File == bad, t, fmt.Sprintf("wrong file %s", pe.File))
+	assert(!errors.Is(err, context.Canceled), t, "error is the cancellation")
+
+	// both bad
+	_, err = pkg.OpenPackageDB(bad, bad)
+	assert(errors.As(err, &pe), t, fmt.Sprintf("expected parse error, saw %v", err))
+	assert(!errors.Is(err, context.Canceled), t, "error is the cancellation")
+}
+
+func TestUpdatedRenamed(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/updated.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.google.android.webview")
+	assert(p != nil, t, "can't find webview")
+	assert(p.Path == "/data/app/com.google.android.webview-1", t, fmt.Sprintf("wrong path %s", p.Path))
+	assert(p.IsUpdatedSystemApp(), t, "webview isn't an updated system app")
+
+	p = db.GetByName("com.example.notes")
+	assert(!p.IsUpdatedSystemApp(), t, "notes is an updated system app")
+
+	assert(db.OriginalName("com.example.todo.pro") == "com.example.todo", t, "wrong original name")
+	assert(db.OriginalName("com.example.notes") == "com.example.notes", t, "notes was renamed")
+
+	// and they survive a write
+	var b bytes.Buffer
+	assert(db.WriteXML(&b) == nil, t, "write xml failed")
+	db, err = pkg.OpenPackageDBReader(&b, strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.GetByName("com.google.android.webview").IsUpdatedSystemApp(), t, "lost updated package")
+	assert(db.OriginalName("com.example.todo.pro") == "com.example.todo", t, "lost renamed package")
+}
+
+func TestMaxPackages(t *testing.T) {
+	_, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list", pkg.WithMaxPackages(3))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	_, err = pkg.OpenPackageDB("../packages.xml", "testdata/packages.list", pkg.WithMaxPackages(3))
+	assert(errors.Is(err, pkg.ErrTooManyPackages), t, fmt.Sprintf("expected too many pkgs, saw %v", err))
+
+	_, err = pkg.OpenPackageDB("testdata/packages.xml", "../packages.list", pkg.WithMaxPackages(3))
+	assert(errors.Is(err, pkg.ErrTooManyPackages), t, fmt.Sprintf("expected too many pkgs, saw %v", err))
+
+	var pe *pkg.ParseError
+	assert(errors.As(err, &pe), t, "not a parse error")
+	assert(pe.Line == 4, t, fmt.Sprintf("wrong line %d", pe.Line))
+
+	// lenient mode doesn't skip past the limit
+	_, err = pkg.OpenPackageDBStrict("../packages.xml", "../packages.list", false, pkg.WithMaxPackages(10))
+	assert(errors.Is(err, pkg.ErrTooManyPackages), t, fmt.Sprintf("expected too many pkgs, saw %v", err))
+
+	_, err = pkg.OpenPackageDB("../packages.xml", "../packages.list", pkg.WithMaxPackages(0))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+}
+
+func TestNewPackageDB(t *testing.T) {
+	db := pkg.NewPackageDB([]*pkg.Pkg{
+		{Name: "com.example.notes", Uid: 10050, Path: "/data/app/com.example.notes-1", Installer: "com.android.vending", SEinfo: "default", Enabled: true,
+			DataPath: "/data/user/0/com.example.notes"},
+		{Name: "com.example.todo", Uid: 10051, Path: "/data/app/com.example.todo-1", Installer: "com.android.vending", Enabled: true},
+		{Name: "com.example.shared", Uid: 10051},
+	})
+
+	assert(db.Len() == 3, t, fmt.Sprintf("expected 3 pkgs, saw %d", db.Len()))
+	assert(db.GetByName("com.example.notes").Uid == 10050, t, "can't find com.example.notes")
+	assert(len(db.GetListByUid(10051)) == 2, t, "expected 2 pkgs for uid 10051")
+	assert(len(db.GetByInstaller("com.android.vending")) == 2, t, "expected 2 pkgs for vending")
+	assert(db.GetByCodePath("/data/app/com.example.todo-1/base.apk").Name == "com.example.todo", t, "can't find by code path")
+	assert(len(db.GetBySEinfo("default")) == 1, t, "expected 1 pkg with seinfo default")
+	assert(db.GetByName("caller-uid-0") == nil, t, "unexpected self pkg")
+	assert(db.Refresh() == nil, t, "refresh failed")
+	assert(db.Len() == 3, t, "refresh changed the DB")
+
+	n := 0
+	for p := range db.IterateByName() {
+		assert(p.Uid >= 10050, t, "wrong uid")
+		n++
+	}
+	assert(n == 3, t, fmt.Sprintf("iterated over %d pkgs", n))
+
+	// the packages survive a trip through packages.xml and
+	// packages.list; only the one left with the zero Enabled is
+	// disabled
+	var b, l bytes.Buffer
+	assert(db.WriteXML(&b) == nil, t, "write xml failed")
+	assert(db.WriteList(&l) == nil, t, "write list failed")
+	rt, err := pkg.OpenPackageDBReader(&b, &l, pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(rt.Len() == 3, t, fmt.Sprintf("expected 3 pkgs after round trip, saw %d", rt.Len()))
+	for _, nm := range db.Names() {
+		p, q := db.GetByName(nm), rt.GetByName(nm)
+		assert(q != nil, t, fmt.Sprintf("%s: lost in the round trip", nm))
+		same := p.Name == q.Name && p.Uid == q.Uid && p.Path == q.Path &&
+			p.Installer == q.Installer && p.DataPath == q.DataPath &&
+			p.SEinfo == q.SEinfo && p.Enabled == q.Enabled
+		assert(same, t, fmt.Sprintf("%s: round trip changed the package: %+v", nm, q))
+	}
+	assert(rt.GetByName("com.example.notes").Enabled, t, "enabled package written as disabled")
+	assert(!rt.GetByName("com.example.shared").Enabled, t, "disabled package written as enabled")
+}
+
+func TestStorageType(t *testing.T) {
+	tests := []struct {
+		path string
+		st   pkg.StorageType
+	}{
+		{"/data/app/com.example.notes-1", pkg.StorageInternal},
+		{"/system/priv-app/TelephonyProvider", pkg.StorageInternal},
+		{"/mnt/expand/7d1a1b4c-0b4e-4b52-9c2d-3e2f5e0b8c1a/app/com.example.notes-1", pkg.StorageAdopted},
+		{"/mnt/asec/com.example.notes-1", pkg.StorageExternal},
+		{"/storage/emulated/0/com.example.notes-1.apk", pkg.StorageExternal},
+		{"/datax/app/com.example.notes-1", pkg.StorageUnknown},
+		{"", pkg.StorageUnknown},
+	}
+
+	for _, x := range tests {
+		p := &pkg.Pkg{Name: "com.example.notes", Path: x.path}
+		st := p.StorageType()
+		assert(st == x.st, t, fmt.Sprintf("%q: expected %s, saw %s", x.path, x.st, st))
+	}
+}
+
+func TestGid(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	var names []string
+	for _, p := range db.GetByGid(3003) {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	want := []string{"com.android.providers.telephony", "com.example.notes"}
+	assert(slices.Equal(names, want), t, fmt.Sprintf("wrong pkgs for gid 3003: %v", names))
+
+	pv := db.GetByGid(3001)
+	assert(len(pv) == 1 && pv[0].Name == "com.android.providers.telephony", t, "wrong pkgs for gid 3001")
+	assert(db.GetByGid(9999) == nil, t, "unexpected pkgs for gid 9999")
+}
+
+func TestContentHash(t *testing.T) {
+	xml, err := os.ReadFile("testdata/packages.xml")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	list, err := os.ReadFile("testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	db, err := pkg.OpenPackageDBReader(bytes.NewReader(xml), bytes.NewReader(list))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	h := db.ContentHash()
+	assert(len(h) == 32, t, fmt.Sprintf("wrong hash length %d", len(h)))
+
+	// reverse the lines of packages.list
+	lines := strings.Split(strings.TrimSpace(string(list)), "\n")
+	slices.Reverse(lines)
+	rev := strings.Join(lines, "\n")
+
+	db2, err := pkg.OpenPackageDBReader(bytes.NewReader(xml), strings.NewReader(rev))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(bytes.Equal(h, db2.ContentHash()), t, "reordering changed the hash")
+
+	// and a real change is noticed
+	p := db2.GetByName("com.example.notes")
+	p.VersionCode++
+	assert(!bytes.Equal(h, db2.ContentHash()), t, "version change didn't change the hash")
+}
+
+func TestSigningLineage(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/lineage.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.rotated")
+	assert(p != nil, t, "can't find com.example.rotated")
+	assert(len(p.Certs) == 1, t, fmt.Sprintf("expected 1 cert, saw %d", len(p.Certs)))
+	assert(p.Cert.Subject.CommonName == "Example New Key", t, fmt.Sprintf("wrong cert %s", p.Cert.Subject.CommonName))
+
+	assert(len(p.SigningLineage) == 2, t, fmt.Sprintf("expected 2 certs in lineage, saw %d", len(p.SigningLineage)))
+	assert(p.SigningLineage[0].Subject.CommonName == "Example Old Key", t, "wrong oldest cert")
+	assert(p.SigningLineage[1] == p.Cert, t, "newest cert isn't the current one")
+
+	var b bytes.Buffer
+	assert(db.WriteXML(&b) == nil, t, "write xml failed")
+	db2, err := pkg.OpenPackageDBReader(&b, strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	q := db2.GetByName("com.example.rotated")
+	assert(len(q.SigningLineage) == 2, t, "lineage lost in write")
+	assert(bytes.Equal(q.SigningLineage[0].Raw, p.SigningLineage[0].Raw), t, "wrong lineage after write")
+
+	// no <pastSigs>: the lineage is just the signing cert
+	p = db.GetByName("com.example.legacy")
+	assert(p != nil, t, "can't find com.example.legacy")
+	assert(len(p.SigningLineage) == 1, t, fmt.Sprintf("expected 1 cert in lineage, saw %d", len(p.SigningLineage)))
+	assert(p.SigningLineage[0].Subject.CommonName == "Example Old Key", t, "wrong legacy cert")
+}
+
+func TestDump(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/shared.xml", "testdata/packages.list", pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	s := db.String()
+	want := fmt.Sprintf("PackageDB: %d packages, %d uids, %d shared uids", db.Len(), len(db.Uids()), len(db.ListSharedUsers()))
+	assert(strings.HasPrefix(s, want), t, fmt.Sprintf("wrong summary %q", s))
+
+	var b bytes.Buffer
+	assert(db.Dump(&b) == nil, t, "dump failed")
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert(len(lines) == db.Len(), t, fmt.Sprintf("expected %d lines, saw %d", db.Len(), len(lines)))
+	assert(sort.StringsAreSorted(lines), t, "dump isn't sorted")
+	assert(lines[0] == db.GetByName(db.Names()[0]).String(), t, fmt.Sprintf("wrong line %q", lines[0]))
+}
+
+func TestHexAttrs(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/hexuid.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p.Uid == 10050, t, fmt.Sprintf("wrong uid %d", p.Uid))
+	assert(p.Flags == 0x38488244, t, fmt.Sprintf("wrong flags %#x", p.Flags))
+
+	p = db.GetByName("com.example.todo")
+	assert(p.Uid == 10051, t, fmt.Sprintf("wrong uid %d", p.Uid))
+	assert(p.Flags == 0xb837c144, t, fmt.Sprintf("wrong flags %#x", p.Flags))
+
+	p = db.GetByName("com.android.providers.telephony")
+	assert(p.Uid == 1001 && p.SharedUid == 1001, t, fmt.Sprintf("wrong uid %d/%d", p.Uid, p.SharedUid))
+
+	_, err = pkg.OpenPackageDB("testdata/baduid.xml", "testdata/packages.list")
+	var pe *pkg.ParseError
+	assert(errors.As(err, &pe), t, fmt.Sprintf("expected parse error, saw %v", err))
+	assert(pe.Package == "com.example.notes", t, fmt.Sprintf("wrong package %q", pe.Package))
+	assert(strings.Contains(err.Error(), "userId <0xzz>"), t, fmt.Sprintf("unclear error: %s", err))
+}
+
+func TestBackupFallback(t *testing.T) {
+	dir := copyFixtures(t, "packages.xml", "packages.list")
+	xml := filepath.Join(dir, "packages.xml")
+	list := filepath.Join(dir, "packages.list")
+	backup := filepath.Join(dir, "packages-backup.xml")
+
+	db, err := pkg.OpenPackageDB(xml, list, pkg.WithBackupFallback(true))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.XMLFile() == xml, t, fmt.Sprintf("wrong xml file %s", db.XMLFile()))
+
+	// corrupt the primary and make the backup valid
+	assert(os.Rename(xml, backup) == nil, t, "rename failed")
+	assert(os.WriteFile(xml, []byte("<packages><package name="), 0600) == nil, t, "write failed")
+
+	_, err = pkg.OpenPackageDB(xml, list)
+	assert(err != nil, t, "corrupt xml parsed without fallback")
+
+	db, err = pkg.OpenPackageDB(xml, list, pkg.WithBackupFallback(true))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.XMLFile() == backup, t, fmt.Sprintf("wrong xml file %s", db.XMLFile()))
+	assert(db.GetByName("com.example.notes").Cert != nil, t, "no cert from backup")
+
+	// an empty primary is just as bad
+	assert(os.WriteFile(xml, nil, 0600) == nil, t, "truncate failed")
+	db, err = pkg.OpenPackageDB(xml, list, pkg.WithBackupFallback(true))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.XMLFile() == backup, t, fmt.Sprintf("wrong xml file %s", db.XMLFile()))
+
+	// if both are bad, the primary's error is returned
+	assert(os.WriteFile(backup, nil, 0600) == nil, t, "truncate failed")
+	_, err = pkg.OpenPackageDB(xml, list, pkg.WithBackupFallback(true))
+	var pe *pkg.ParseError
+	assert(errors.As(err, &pe) && pe.File == xml, t, fmt.Sprintf("expected error for %s, saw %v", xml, err))
+}
+
+func TestCpuAbi(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/abi.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p.PrimaryCpuAbi == "arm64-v8a", t, fmt.Sprintf("wrong primary abi %q", p.PrimaryCpuAbi))
+	assert(p.SecondaryCpuAbi == "armeabi-v7a", t, fmt.Sprintf("wrong secondary abi %q", p.SecondaryCpuAbi))
+	assert(p.CpuAbiOverride == "", t, fmt.Sprintf("wrong abi override %q", p.CpuAbiOverride))
+
+	p = db.GetByName("com.example.game")
+	assert(p.PrimaryCpuAbi == "armeabi-v7a", t, fmt.Sprintf("wrong primary abi %q", p.PrimaryCpuAbi))
+	assert(p.CpuAbiOverride == "armeabi-v7a", t, fmt.Sprintf("wrong abi override %q", p.CpuAbiOverride))
+
+	p = db.GetByName("com.example.todo")
+	assert(p.PrimaryCpuAbi == "" && p.SecondaryCpuAbi == "" && p.CpuAbiOverride == "", t, "unexpected abis")
+}
+
+func TestOrphanedUids(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(db.OrphanedUids()) == 0, t, fmt.Sprintf("unexpected orphans %v", db.OrphanedUids()))
+
+	// com.example.todo (10051) is only in the xml and com.example.gone
+	// (10077) only in the list
+	db, err = pkg.OpenPackageDB("testdata/packages.xml", "testdata/orphan.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	u := db.OrphanedUids()
+	assert(slices.Equal(u, []uint32{10051, 10077}), t, fmt.Sprintf("wrong orphans %v", u))
+
+	db, err = pkg.OpenPackageDB("../packages.xml", "../packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(db.OrphanedUids()) == 0, t, fmt.Sprintf("unexpected orphans %v", db.OrphanedUids()))
+}
+
+func TestKeySets(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/keyset.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	ks := db.KeySets()
+	assert(len(ks) == 2, t, fmt.Sprintf("expected 2 keysets, saw %d", len(ks)))
+	assert(ks[0].ID == 1 && ks[1].ID == 2, t, "keysets not sorted")
+
+	p := db.GetByName("com.example.notes")
+	assert(p.SigningKeySet == ks[0], t, "wrong signing keyset")
+	assert(bytes.Equal(p.SigningKeySet.Keys[0], p.Cert.RawSubjectPublicKeyInfo), t, "signing key isn't the cert's key")
+	assert(len(p.KeySetAliases) == 1 && p.KeySetAliases["upgrade"] == ks[1], t, "wrong keyset alias")
+
+	// unknown keyset ids are ignored
+	p = db.GetByName("com.example.todo")
+	assert(p.SigningKeySet == nil, t, "unexpected signing keyset")
+
+	// no <keyset-settings>
+	db, err = pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(db.KeySets()) == 0, t, "unexpected keysets")
+	assert(db.GetByName("com.example.notes").SigningKeySet == nil, t, "unexpected signing keyset")
+
+	db, err = pkg.OpenPackageDB("../packages.xml", "../packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(db.KeySets()) == 10, t, fmt.Sprintf("expected 10 keysets, saw %d", len(db.KeySets())))
+	p = db.GetByName("com.android.providers.telephony")
+	assert(p.SigningKeySet != nil, t, "telephony has no signing keyset")
+	assert(bytes.Equal(p.SigningKeySet.Keys[0], p.Cert.RawSubjectPublicKeyInfo), t, "telephony signing key isn't the cert's key")
+}
+
+func TestAtomicRefresh(t *testing.T) {
+	dir := copyFixtures(t, "packages.xml", "packages.list")
+	xml := filepath.Join(dir, "packages.xml")
+	list := filepath.Join(dir, "packages.list")
+
+	db, err := pkg.OpenPackageDB(xml, list)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	a := db.GetByName("com.example.notes")
+	assert(a != nil && a.Cert != nil, t, "can't find com.example.notes")
+
+	// a truncated packages.xml next to an updated packages.list
+	good, err := os.ReadFile(xml)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(os.WriteFile(xml, good[:len(good)/2], 0600) == nil, t, "truncate failed")
+
+	fd, err := os.OpenFile(list, os.O_APPEND|os.O_WRONLY, 0600)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	fmt.Fprintf(fd, "com.example.new 10052 0 /data/user/0/com.example.new default none\n")
+	fd.Close()
+
+	fut := time.Now().Add(time.Hour)
+	assert(os.Chtimes(xml, fut, fut) == nil, t, "chtimes xml")
+	assert(os.Chtimes(list, fut, fut) == nil, t, "chtimes list")
+
+	assert(db.Refresh() != nil, t, "truncated xml parsed")
+	assert(db.GetByName("com.example.notes") == a, t, "old data was replaced")
+	assert(db.GetByName("com.example.new") == nil, t, "new list data was swapped in")
+
+	// a missing file doesn't make a complete DB partial
+	assert(os.Remove(xml) == nil, t, "remove failed")
+	err = db.Refresh()
+	assert(errors.Is(err, os.ErrNotExist) && !errors.Is(err, pkg.ErrPartialDB), t, fmt.Sprintf("wrong error %v", err))
+	assert(db.GetByName("com.example.notes") == a, t, "old data was replaced")
+
+	// and the good file is picked up once it's back
+	assert(os.WriteFile(xml, good, 0600) == nil, t, "write failed")
+	assert(os.Chtimes(xml, fut, fut) == nil, t, "chtimes xml")
+	assert(db.Refresh() == nil, t, "refresh failed")
+	assert(db.GetByName("com.example.new") != nil, t, "new list data is missing")
+	assert(db.GetByName("com.example.notes").Cert != nil, t, "xml data is missing")
+}
+
+func TestUidClass(t *testing.T) {
+	db := pkg.NewPackageDB([]*pkg.Pkg{
+		{Name: "android", Uid: 1000},
+		{Name: "com.android.phone", Uid: 1001, SharedUid: 1001},
+		{Name: "com.example.notes", Uid: 10050},
+		{Name: "com.example.notes.work", Uid: 1010050},
+		{Name: "com.example.sandbox", Uid: 20050},
+		{Name: "com.example.isolated", Uid: 99001},
+		{Name: "com.example.zygote", Uid: 90001},
+		{Name: "com.example.odd", Uid: 50001},
+	})
+
+	tests := map[string]pkg.UidClass{
+		"android":                pkg.UidSystem,
+		"com.android.phone":      pkg.UidShared,
+		"com.example.notes":      pkg.UidApp,
+		"com.example.notes.work": pkg.UidApp,
+		"com.example.sandbox":    pkg.UidSdkSandbox,
+		"com.example.isolated":   pkg.UidIsolatedProcess,
+		"com.example.zygote":     pkg.UidIsolatedProcess,
+		"com.example.odd":        pkg.UidUnknown,
+	}
+
+	for nm, c := range tests {
+		p := db.GetByName(nm)
+		assert(p.UidClass() == c, t, fmt.Sprintf("%s: expected %s, saw %s", nm, c, p.UidClass()))
+	}
+
+	pv := db.GetByUidClass(pkg.UidIsolatedProcess)
+	assert(len(pv) == 2, t, fmt.Sprintf("expected 2 isolated pkgs, saw %d", len(pv)))
+	assert(pv[0].Name == "com.example.zygote", t, "isolated pkgs not sorted by uid")
+
+	pv = db.GetByUidClass(pkg.UidApp)
+	assert(len(pv) == 2 && pv[0].Uid == 10050, t, "wrong app pkgs")
+	assert(len(db.GetByUidClass(pkg.UidSystem)) == 1, t, "wrong system pkgs")
+}
+
+func TestFindByNameFold(t *testing.T) {
+	db := pkg.NewPackageDB([]*pkg.Pkg{
+		{Name: "com.foo", Uid: 10050},
+		{Name: "com.Foo", Uid: 10051},
+		{Name: "com.foobar", Uid: 10052},
+	})
+
+	pv := db.FindByNameFold("Com.Foo")
+	assert(len(pv) == 2, t, fmt.Sprintf("expected 2 matches, saw %d", len(pv)))
+	assert(pv[0].Name == "com.Foo" && pv[1].Name == "com.foo", t, "matches not sorted")
+
+	pv = db.FindByNameFold("COM.FOOBAR")
+	assert(len(pv) == 1 && pv[0].Uid == 10052, t, "can't find com.foobar")
+	assert(db.FindByNameFold("com.fo") == nil, t, "unexpected partial match")
+	assert(db.GetByName("Com.Foo") == nil, t, "GetByName isn't exact")
+}
+
+func TestWriteCSV(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	// paths and seinfo can have spaces and commas
+	p := db.GetByName("com.example.todo")
+	p.Path = "/data/app/My Apps/com.example.todo-1"
+	p.SEinfo = "default,privapp"
+
+	var b bytes.Buffer
+	assert(db.WriteCSV(&b) == nil, t, "write csv failed")
+
+	rows, err := csv.NewReader(&b).ReadAll()
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(slices.Equal(rows[0], []string{"name", "uid", "version", "installer", "seinfo", "certhash", "path"}), t,
+		fmt.Sprintf("wrong header %v", rows[0]))
+	assert(len(rows) == 4, t, fmt.Sprintf("expected 4 rows, saw %d", len(rows)))
+
+	notes := rows[2]
+	assert(notes[0] == "com.example.notes" && notes[1] == "10050", t, fmt.Sprintf("wrong row %v", notes))
+	assert(notes[5] == hex.EncodeToString(db.GetByName("com.example.notes").Certhash), t, "wrong certhash")
+
+	todo := rows[3]
+	assert(todo[0] == "com.example.todo", t, fmt.Sprintf("wrong row %v", todo))
+	assert(todo[4] == p.SEinfo, t, fmt.Sprintf("wrong seinfo %q", todo[4]))
+	assert(todo[6] == p.Path, t, fmt.Sprintf("wrong path %q", todo[6]))
+}
+
+func TestOpenDir(t *testing.T) {
+	dir := copyFixtures(t, "packages.xml", "packages.list")
+	xml := filepath.Join(dir, "packages.xml")
+
+	db, err := pkg.OpenPackageDBDir(dir)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.XMLFile() == xml, t, fmt.Sprintf("wrong xml file %s", db.XMLFile()))
+	assert(db.GetByName("com.example.notes") != nil, t, "missing notes")
+
+	// Only the backup is left
+	backup := filepath.Join(dir, "packages-backup.xml")
+	assert(os.Rename(xml, backup) == nil, t, "rename failed")
+
+	db, err = pkg.OpenPackageDBDir(dir)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.XMLFile() == backup, t, fmt.Sprintf("wrong xml file %s", db.XMLFile()))
+
+	_, err = pkg.OpenPackageDBDir(dir, pkg.WithBackupFallback(false))
+	assert(errors.Is(err, pkg.ErrPartialDB), t, fmt.Sprintf("expected partial DB, saw %v", err))
+
+	// Neither file
+	empty := t.TempDir()
+	_, err = pkg.OpenPackageDBDir(empty)
+	assert(errors.Is(err, fs.ErrNotExist), t, fmt.Sprintf("expected not-exist, saw %v", err))
+
+	_, err = pkg.OpenPackageDBDir(filepath.Join(empty, "nope"))
+	assert(errors.Is(err, fs.ErrNotExist), t, fmt.Sprintf("expected not-exist, saw %v", err))
+
+	_, err = pkg.OpenPackageDBDir(filepath.Join(dir, "packages.list"))
+	assert(err != nil, t, "opened a file as a dir")
+}
+
+func TestStats(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list", pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	st := db.Stats()
+	assert(st.PackageCount == 3, t, fmt.Sprintf("wrong package count %d", st.PackageCount))
+	assert(st.CertCount == 2, t, fmt.Sprintf("wrong cert count %d", st.CertCount))
+	assert(st.SharedUidCount == 1, t, fmt.Sprintf("wrong shared uid count %d", st.SharedUidCount))
+	assert(st.CertFailures == 0, t, fmt.Sprintf("wrong cert failures %d", st.CertFailures))
+	assert(st.LastParseDuration > 0, t, "no parse duration")
+
+	// com.example.notes has a garbage cert
+	db, err = pkg.OpenPackageDBStrict("testdata/badcert.xml", "testdata/packages.list", false, pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	st = db.Stats()
+	assert(st.CertFailures == 1, t, fmt.Sprintf("wrong cert failures %d", st.CertFailures))
+	assert(st.CertCount == 1, t, fmt.Sprintf("wrong cert count %d", st.CertCount))
+	assert(st.PackageCount == 3, t, fmt.Sprintf("wrong package count %d", st.PackageCount))
+}
+
+func TestBadCert(t *testing.T) {
+	_, err := pkg.OpenPackageDB("testdata/badcert.xml", "testdata/packages.list")
+	var pe *pkg.ParseError
+	assert(errors.As(err, &pe), t, fmt.Sprintf("strict mode accepted a bad cert: %v", err))
+	assert(pe.Package == "com.example.notes", t, fmt.Sprintf("wrong package %q", pe.Package))
+
+	db, err := pkg.OpenPackageDBStrict("testdata/badcert.xml", "testdata/packages.list", false)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	// the package is there, just without certs
+	p := db.GetByName("com.example.notes")
+	assert(p != nil, t, "package with bad cert skipped")
+	assert(p.Cert == nil && len(p.Certs) == 0 && len(p.Certhash) == 0, t, "package with bad cert has a cert")
+	assert(p.Uid == 10050 && p.DataPath == "/data/user/0/com.example.notes", t, fmt.Sprintf("wrong package %s", p))
+
+	// the other packages are unaffected
+	assert(db.GetByName("com.android.providers.telephony").Cert != nil, t, "good cert lost")
+
+	st := db.Stats()
+	assert(len(st.CertErrors) == 1, t, fmt.Sprintf("expected 1 cert error, saw %v", st.CertErrors))
+	assert(errors.As(st.CertErrors[0], &pe) && pe.Package == "com.example.notes", t,
+		fmt.Sprintf("wrong cert error %v", st.CertErrors[0]))
+	assert(pe.File == "testdata/badcert.xml", t, fmt.Sprintf("wrong file %q", pe.File))
+}
+
+func TestLazyCerts(t *testing.T) {
+	xml, list := "testdata/packages.xml", "testdata/packages.list"
+
+	db, err := pkg.OpenPackageDB(xml, list)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	lazy, err := pkg.OpenPackageDB(xml, list, pkg.WithLazyCerts(true))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	q := lazy.GetByName("com.example.notes")
+	assert(q.Cert == nil && len(q.Certs) == 0, t, "lazy cert parsed up front")
+	assert(bytes.Equal(p.Certhash, q.Certhash), t, "wrong lazy cert hash")
+	assert(bytes.Equal(p.Certhash256, q.Certhash256), t, "wrong lazy cert sha256 hash")
+	assert(bytes.Equal(p.CertDER, q.CertDER), t, "wrong lazy cert DER")
+
+	c, err := q.Certificate()
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(c != nil && bytes.Equal(c.Raw, p.Cert.Raw), t, "wrong lazy cert")
+
+	c2, _ := q.Certificate()
+	assert(c2 == c, t, "lazy cert parsed twice")
+
+	c, err = p.Certificate()
+	assert(err == nil && c == p.Cert, t, "wrong eager cert")
+
+	c, err = lazy.GetByName("com.example.todo").Certificate()
+	assert(err == nil && c == nil, t, "cert for unsigned package")
+
+	// the helpers parse the cert as needed
+	assert(q.SameSigner(p), t, "lazy cert isn't the same signer")
+	assert(lazy.Validate() == nil, t, fmt.Sprintf("lazy DB invalid: %v", lazy.Validate()))
+
+	var b1, b2 bytes.Buffer
+	assert(db.WriteXML(&b1) == nil, t, "write xml failed")
+	assert(lazy.WriteXML(&b2) == nil, t, "write lazy xml failed")
+	assert(bytes.Equal(b1.Bytes(), b2.Bytes()), t, "lazy DB writes different xml")
+
+	// a garbage cert only shows up when it's used
+	lazy, err = pkg.OpenPackageDB("testdata/badcert.xml", list, pkg.WithLazyCerts(true))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	c, err = lazy.GetByName("com.example.notes").Certificate()
+	assert(c == nil && err != nil, t, "garbage cert parsed")
+}
+
+func TestVolumeUuid(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/adopted.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	const uuid = "b8f3c2a1-5d6e-4f70-8a91-0c2d3e4f5a6b"
+	tests := []struct {
+		uuid  string
+		names []string
+	}{
+		{pkg.VolumeInternal, []string{"com.android.providers.telephony", "com.example.notes"}},
+		{pkg.VolumePrimaryPhysical, []string{"com.example.todo"}},
+		{uuid, []string{"com.example.game"}},
+		{strings.ToUpper(uuid), []string{"com.example.game"}},
+		{strings.ToUpper(pkg.VolumePrimaryPhysical), nil},
+		{"nope", nil},
+	}
+
+	for _, x := range tests {
+		var names []string
+		for _, p := range db.GetByVolumeUuid(x.uuid) {
+			names = append(names, p.Name)
+		}
+		assert(slices.Equal(names, x.names), t, fmt.Sprintf("%q: expected %v, saw %v", x.uuid, x.names, names))
+	}
+
+	p := db.GetByName("com.example.game")
+	assert(p.VolumeUuid == uuid, t, fmt.Sprintf("wrong volume %q", p.VolumeUuid))
+	assert(p.StorageType() == pkg.StorageAdopted, t, fmt.Sprintf("wrong storage %s", p.StorageType()))
+
+	// packages without a volume are on the header's
+	xml := `<packages>
+    <version volumeUuid="` + uuid + `" sdkVersion="28" />
+    <package name="com.example.notes" codePath="/mnt/expand/` + uuid + `/app/com.example.notes-1" userId="10050" />
+</packages>`
+	db, err = pkg.OpenPackageDBReader(strings.NewReader(xml), strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.GetByName("com.example.notes").VolumeUuid == uuid, t, "no volume from header")
+
+	// and the volume survives a round trip
+	db, err = pkg.OpenPackageDB("testdata/adopted.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	var b bytes.Buffer
+	assert(db.WriteXML(&b) == nil, t, "write xml failed")
+	db, err = pkg.OpenPackageDBReader(&b, strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.GetByName("com.example.game").VolumeUuid == uuid, t, "volume lost by WriteXML")
+	assert(db.GetByName("com.example.todo").VolumeUuid == pkg.VolumePrimaryPhysical, t, "volume lost by WriteXML")
+}
+
+func TestSigners(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/signers.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p.SignerCount == 2, t, fmt.Sprintf("wrong signer count %d", p.SignerCount))
+	assert(slices.Equal(p.SignatureSchemes, []string{"v3"}), t, fmt.Sprintf("wrong schemes %v", p.SignatureSchemes))
+
+	// no attributes: count the certs
+	p = db.GetByName("com.example.todo")
+	assert(p.SignerCount == 1, t, fmt.Sprintf("wrong signer count %d", p.SignerCount))
+	assert(len(p.SignatureSchemes) == 0, t, fmt.Sprintf("wrong schemes %v", p.SignatureSchemes))
+
+	p = db.GetByName("com.example.game")
+	assert(p.SignerCount == 0, t, fmt.Sprintf("wrong signer count %d", p.SignerCount))
+
+	var b bytes.Buffer
+	assert(db.WriteXML(&b) == nil, t, "write xml failed")
+	db, err = pkg.OpenPackageDBReader(&b, strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p = db.GetByName("com.example.notes")
+	assert(p.SignerCount == 2 && slices.Equal(p.SignatureSchemes, []string{"v3"}), t,
+		fmt.Sprintf("signers lost by WriteXML: %d %v", p.SignerCount, p.SignatureSchemes))
+
+	_, err = pkg.OpenPackageDBReader(strings.NewReader(`<packages>
+    <package name="com.example.notes" userId="10050"><sigs count="two" /></package>
+</packages>`), strings.NewReader(""))
+	assert(err != nil, t, "bad sigs count parsed")
+}
+
+func TestFilterFunc(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	names := func(pv []*pkg.Pkg) []string {
+		var v []string
+		for _, p := range pv {
+			v = append(v, p.Name)
+		}
+		return v
+	}
+
+	after := time.Date(2009, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc  string
+		pred  func(p *pkg.Pkg) bool
+		names []string
+	}{
+		{"debug", func(p *pkg.Pkg) bool { return p.Debug }, []string{"com.example.todo"}},
+		{"system", (*pkg.Pkg).IsSystemApp, []string{"com.android.providers.telephony"}},
+		{"cert after 2009", func(p *pkg.Pkg) bool {
+			return p.Cert != nil && p.Cert.NotBefore.After(after)
+		}, []string{"com.example.notes"}},
+		{"debuggable system", func(p *pkg.Pkg) bool {
+			return p.IsDebuggable() && p.IsSystemApp() && !p.IsUpdatedSystemApp()
+		}, nil},
+	}
+
+	for _, x := range tests {
+		v := names(db.FilterFunc(x.pred))
+		assert(slices.Equal(v, x.names), t, fmt.Sprintf("%s: expected %v, saw %v", x.desc, x.names, v))
+	}
+}
+
+func TestIterateSorted(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	var names []string
+	for p := range db.IterateByNameSorted() {
+		names = append(names, p.Name)
+	}
+	assert(sort.StringsAreSorted(names), t, fmt.Sprintf("unsorted: %v", names))
+	assert(slices.Equal(names, db.Names()), t, fmt.Sprintf("expected %v, saw %v", db.Names(), names))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := db.IterateByNameSortedContext(ctx)
+	p := <-ch
+	cancel()
+	assert(p != nil && p.Name == names[0], t, "wrong first package")
+}
+
+func TestCertDER(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	for _, nm := range []string{"com.android.providers.telephony", "com.example.notes"} {
+		p := db.GetByName(nm)
+		h := sha1.Sum(p.CertDER)
+		assert(bytes.Equal(h[:], p.Certhash), t, fmt.Sprintf("%s: cert DER doesn't match its hash", nm))
+		assert(bytes.Equal(p.CertDER, p.Cert.Raw), t, fmt.Sprintf("%s: cert DER isn't the cert's", nm))
+	}
+
+	p := db.GetByName("com.example.todo")
+	assert(p.CertDER == nil, t, "cert DER for unsigned package")
+}
+
+func TestRuntimePermissions(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/shared.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	notes := db.GetByName("com.example.notes")
+	assert(notes.GrantedPermissions(0) == nil, t, "permissions before loading")
+
+	err = db.LoadRuntimePermissions(0, "testdata/runtime-permissions.xml")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	want := []string{"android.permission.ACCESS_FINE_LOCATION", "android.permission.CAMERA"}
+	v := notes.GrantedPermissions(0)
+	assert(slices.Equal(v, want), t, fmt.Sprintf("expected %v, saw %v", want, v))
+	assert(notes.GrantedPermissions(10) == nil, t, "permissions for unknown user")
+
+	// shared users
+	v = db.GetByName("com.android.providers.telephony").GrantedPermissions(0)
+	assert(slices.Equal(v, []string{"android.permission.READ_PHONE_STATE"}), t, fmt.Sprintf("wrong shared user permissions %v", v))
+	assert(db.GetByName("android").GrantedPermissions(0) == nil, t, "permissions for android")
+
+	// unknown packages and shared users are noted
+	var n int
+	for _, w := range db.Warnings() {
+		if strings.Contains(w, "com.example.gone") || strings.Contains(w, "android.uid.bogus") {
+			n++
+		}
+	}
+	assert(n == 2, t, fmt.Sprintf("expected 2 warnings, saw %v", db.Warnings()))
+
+	// and the permissions survive a refresh
+	err = db.Refresh()
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	v = db.GetByName("com.example.notes").GrantedPermissions(0)
+	assert(slices.Equal(v, want), t, fmt.Sprintf("permissions lost in refresh: %v", v))
+
+	err = db.LoadRuntimePermissions(0, "testdata/nope.xml")
+	assert(errors.Is(err, fs.ErrNotExist), t, fmt.Sprintf("expected not-exist, saw %v", err))
+}
+
+func TestPkgEqual(t *testing.T) {
+	xml, list := "testdata/packages.xml", "testdata/packages.list"
+	a, err := pkg.OpenPackageDB(xml, list)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	b, err := pkg.OpenPackageDB(xml, list, pkg.WithLazyCerts(true))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	// different DBs, cert pointers and cert parsing
+	for _, nm := range a.Names() {
+		p, q := a.GetByName(nm), b.GetByName(nm)
+		assert(p.Equal(q) && q.Equal(p), t, fmt.Sprintf("%s: not equal", nm))
+	}
+
+	p := a.GetByName("com.android.providers.telephony")
+	assert(!p.Equal(nil), t, "equal to nil")
+	assert(!p.Equal(a.GetByName("com.example.notes")), t, "different packages are equal")
+
+	// gid order doesn't matter
+	q := *p
+	q.Gid = []uint32{3003, 3001, 3002, 3001}
+	assert(p.Equal(&q), t, fmt.Sprintf("gids %v != %v", p.Gid, q.Gid))
+	q.Gid = []uint32{3003, 3001}
+	assert(!p.Equal(&q), t, "missing gid is equal")
+
+	q = *p
+	q.Certhash = bytes.Repeat([]byte{1}, 20)
+	assert(!p.Equal(&q), t, "different cert hash is equal")
+
+	q = *p
+	q.LastUpdateTime = q.LastUpdateTime.Add(time.Second)
+	assert(!p.Equal(&q), t, "different update time is equal")
+
+	// by name and then by uid
+	x := &pkg.Pkg{Name: "com.example.notes", Uid: 10050}
+	y := &pkg.Pkg{Name: "com.example.notes", Uid: 1010050}
+	z := &pkg.Pkg{Name: "com.example.alarm", Uid: 1010099}
+	v := []*pkg.Pkg{y, x, z}
+	sort.Slice(v, func(i, j int) bool { return v[i].Less(v[j]) })
+	assert(v[0] == z && v[1] == x && v[2] == y, t, fmt.Sprintf("wrong order %v", v))
+	assert(!x.Less(x), t, "less than itself")
+}
+
+func TestOpenZip(t *testing.T) {
+	dir := t.TempDir()
+	mkzip := func(nm string, files map[string]string) string {
+		fn := filepath.Join(dir, nm)
+		fd, err := os.Create(fn)
+		assert(err == nil, t, fmt.Sprintf("%s", err))
+		defer fd.Close()
+
+		zw := zip.NewWriter(fd)
+		for name, src := range files {
+			w, err := zw.Create(name)
+			assert(err == nil, t, fmt.Sprintf("%s", err))
+			data, err := os.ReadFile(src)
+			assert(err == nil, t, fmt.Sprintf("%s", err))
+			w.Write(data)
+		}
+		assert(zw.Close() == nil, t, "zip close failed")
+		return fn
+	}
+
+	fn := mkzip("dump.zip", map[string]string{
+		"data/system/packages.xml":                     "testdata/packages.xml",
+		"data/system/packages.list":                    "testdata/packages.list",
+		"data/system/users/0/package-restrictions.xml": "testdata/package-restrictions.xml",
+	})
+	db, err := pkg.OpenPackageDBZip(fn)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p != nil && p.Cert != nil, t, "no com.example.notes")
+	assert(p.DataPath == "/data/user/0/com.example.notes", t, fmt.Sprintf("wrong data path %q", p.DataPath))
+
+	// at the top of the archive
+	fn = mkzip("top.zip", map[string]string{
+		"packages.xml":  "testdata/packages.xml",
+		"packages.list": "testdata/packages.list",
+	})
+	db, err = pkg.OpenPackageDBZip(fn)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.GetByName("com.example.notes") != nil, t, "no com.example.notes")
+
+	fn = mkzip("nolist.zip", map[string]string{
+		"system/packages.xml": "testdata/packages.xml",
+	})
+	_, err = pkg.OpenPackageDBZip(fn)
+	assert(errors.Is(err, fs.ErrNotExist), t, fmt.Sprintf("expected not-exist, saw %v", err))
+	assert(strings.Contains(err.Error(), "packages.list"), t, fmt.Sprintf("unclear error: %s", err))
+
+	_, err = pkg.OpenPackageDBZip(filepath.Join(dir, "nope.zip"))
+	assert(err != nil, t, "opened a missing zip")
+}
+
+func TestUnknownElements(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/future.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.GetByName("com.example.notes") != nil, t, "no com.example.notes")
+
+	// each unknown element is noted once
+	want := []string{
+		"testdata/future.xml: unknown element <future-thing>",
+		"testdata/future.xml: unknown element <package/future-child>",
+	}
+	w := db.Warnings()
+	sort.Strings(w)
+	assert(slices.Equal(w, want), t, fmt.Sprintf("expected %v, saw %v", want, w))
+
+	// a real packages.xml has nothing we don't know about
+	db, err = pkg.OpenPackageDB("../packages.xml", "../packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	for _, w := range db.Warnings() {
+		assert(!strings.Contains(w, "unknown element"), t, w)
+	}
+}
+
+func TestSelf(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "android" {
+		t.Skip("the pseudo package has a uid only on posix")
+	}
+
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	uid := uint32(os.Getuid())
+	p := db.Self()
+	assert(p != nil, t, "no self")
+	assert(p.Uid == uid, t, fmt.Sprintf("wrong uid %d; exp %d", p.Uid, uid))
+	assert(p.Name == fmt.Sprintf("caller-uid-%d", uid), t, fmt.Sprintf("wrong name %q", p.Name))
+	assert(db.GetByName(p.Name) == p, t, "self isn't in the DB")
+
+	// and it is the same package after a refresh
+	assert(db.Refresh() == nil, t, "refresh failed")
+	assert(db.Self().Name == p.Name, t, "self changed after refresh")
+	assert(db.Snapshot().Self().Name == p.Name, t, "no self in snapshot")
+
+	db, err = pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list", pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.Self() == nil, t, "self without WithSelf")
+}
+
+func TestInstallSource(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/installers.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(db.Warnings()) == 0, t, fmt.Sprintf("unexpected warnings %v", db.Warnings()))
+
+	tests := []struct {
+		name               string
+		inst, init, origin string
+	}{
+		{"com.example.notes", "com.android.packageinstaller", "com.android.chrome", "com.example.store"},
+		{"com.example.todo", "com.android.vending", "com.android.vending", "com.example.browser"},
+		{"com.example.game", "", "", ""},
+	}
+
+	check := func(db *pkg.PackageDB) {
+		for _, x := range tests {
+			p := db.GetByName(x.name)
+			assert(p.Installer == x.inst, t, fmt.Sprintf("%s: wrong installer %q", x.name, p.Installer))
+			assert(p.InitiatingInstaller == x.init, t, fmt.Sprintf("%s: wrong initiator %q", x.name, p.InitiatingInstaller))
+			assert(p.OriginatingInstaller == x.origin, t, fmt.Sprintf("%s: wrong originator %q", x.name, p.OriginatingInstaller))
+		}
+	}
+	check(db)
+
+	var b bytes.Buffer
+	assert(db.WriteXML(&b) == nil, t, "write xml failed")
+	db, err = pkg.OpenPackageDBReader(&b, strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	check(db)
+}
+
+func TestGetByNameBatch(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	names := []string{"com.example.notes", "com.example.nope", "com.example.todo", "com.example.notes", ""}
+	m := db.GetByNameBatch(names)
+	assert(len(m) == 2, t, fmt.Sprintf("expected 2 packages, saw %d", len(m)))
+	assert(m["com.example.notes"] == db.GetByName("com.example.notes"), t, "wrong com.example.notes")
+	assert(m["com.example.todo"] == db.GetByName("com.example.todo"), t, "wrong com.example.todo")
+
+	_, ok := m["com.example.nope"]
+	assert(!ok, t, "missing package in the result")
+
+	assert(len(db.GetByNameBatch(nil)) == 0, t, "packages for no names")
+}
+
+func TestOnRefresh(t *testing.T) {
+	dir := copyFixtures(t, "packages.xml", "packages.list")
+	xml := filepath.Join(dir, "packages.xml")
+	list := filepath.Join(dir, "packages.list")
+
+	db, err := pkg.OpenPackageDB(xml, list)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	var calls []string
+	db.OnRefresh(func(d *pkg.PackageDB) {
+		assert(d == db, t, "callback has the wrong DB")
+		if d.GetByName("com.example.new") != nil {
+			calls = append(calls, "first")
+		}
+	})
+	db.OnRefresh(func(d *pkg.PackageDB) {
+		calls = append(calls, "second")
+	})
+
+	fd, err := os.OpenFile(list, os.O_APPEND|os.O_WRONLY, 0600)
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	fmt.Fprintf(fd, "com.example.new 10052 0 /data/user/0/com.example.new default none\n")
+	fd.Close()
+
+	err = db.Refresh()
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(slices.Equal(calls, []string{"first", "second"}), t, fmt.Sprintf("wrong callbacks %v", calls))
+
+	// implicit refreshes count too
+	fut := time.Now().Add(time.Hour)
+	assert(os.Chtimes(list, fut, fut) == nil, t, "chtimes list")
+	db.GetByName("com.example.notes")
+	assert(len(calls) == 4, t, fmt.Sprintf("auto refresh didn't call back: %v", calls))
+
+	// failed refreshes don't
+	assert(os.WriteFile(xml, []byte("<packages><package"), 0600) == nil, t, "write failed")
+	assert(db.Refresh() != nil, t, "refresh of corrupt xml worked")
+	assert(len(calls) == 4, t, fmt.Sprintf("failed refresh called back: %v", calls))
+}
+
+func TestDataPathsForUid(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/shared.xml", "testdata/shared.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	// "android" is only in packages.xml
+	assert(len(db.GetListByUid(1000)) == 3, t, fmt.Sprintf("wrong packages %v", db.GetListByUid(1000)))
+
+	want := []string{"/data/user_de/0/com.android.providers.settings", "/data/user_de/0/com.android.settings"}
+	v := db.DataPathsForUid(1000)
+	assert(slices.Equal(v, want), t, fmt.Sprintf("expected %v, saw %v", want, v))
+
+	v = db.DataPathsForUid(10050)
+	assert(slices.Equal(v, []string{"/data/user/0/com.example.notes"}), t, fmt.Sprintf("wrong paths %v", v))
+	assert(db.DataPathsForUid(4242) == nil, t, "paths for unknown uid")
+}
+
+func TestInstallReason(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/reason.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	tests := []struct {
+		name     string
+		reason   int
+		rname    string
+		orphaned bool
+	}{
+		{"com.example.notes", pkg.InstallReasonUser, "user", false},
+		{"com.example.todo", pkg.InstallReasonDeviceSetup, "device-setup", true},
+		{"com.example.game", pkg.InstallReasonUnknown, "unknown", false},
+	}
+
+	check := func(db *pkg.PackageDB) {
+		for _, x := range tests {
+			p := db.GetByName(x.name)
+			assert(p.InstallReason == x.reason, t, fmt.Sprintf("%s: wrong reason %d", x.name, p.InstallReason))
+			assert(pkg.InstallReasonName(p.InstallReason) == x.rname, t,
+				fmt.Sprintf("%s: wrong reason name %q", x.name, pkg.InstallReasonName(p.InstallReason)))
+			assert(p.IsOrphaned == x.orphaned, t, fmt.Sprintf("%s: wrong orphaned %v", x.name, p.IsOrphaned))
+		}
+	}
+	check(db)
+
+	var b bytes.Buffer
+	assert(db.WriteXML(&b) == nil, t, "write xml failed")
+	db, err = pkg.OpenPackageDBReader(&b, strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	check(db)
+
+	assert(pkg.InstallReasonName(42) == "unknown", t, "name for bogus reason")
+}
+
+func TestSplits(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/splits.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	tests := []struct {
+		name   string
+		splits []string
+		apks   []string
+	}{
+		{"com.example.notes", []string{"config.arm64_v8a", "config.xxhdpi"}, []string{
+			"/data/app/~~Xy1bK2Qd8w==/com.example.notes-1/base.apk",
+			"/data/app/~~Xy1bK2Qd8w==/com.example.notes-1/split_config.arm64_v8a.apk",
+			"/data/app/~~Xy1bK2Qd8w==/com.example.notes-1/split_config.xxhdpi.apk",
+		}},
+		{"com.example.todo", nil, []string{"/data/app/~~Pq8TzG3ua1==/com.example.todo-1/base.apk"}},
+		{"com.example.game", nil, []string{"/data/app/com.example.game-1.apk"}},
+	}
+
+	check := func(db *pkg.PackageDB) {
+		for _, x := range tests {
+			p := db.GetByName(x.name)
+			assert(slices.Equal(p.Splits, x.splits), t, fmt.Sprintf("%s: wrong splits %q", x.name, p.Splits))
+			assert(slices.Equal(p.AllApkPaths(), x.apks), t, fmt.Sprintf("%s: wrong apks %q", x.name, p.AllApkPaths()))
+		}
+	}
+	check(db)
+
+	var b bytes.Buffer
+	assert(db.WriteXML(&b) == nil, t, "write xml failed")
+	db, err = pkg.OpenPackageDBReader(&b, strings.NewReader(""))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	check(db)
+
+	var p pkg.Pkg
+	assert(p.AllApkPaths() == nil, t, "apks for a package without a code path")
+}
+
+func TestGroupByInstaller(t *testing.T) {
+	db := pkg.NewPackageDB([]*pkg.Pkg{
+		{Name: "com.example.notes", Uid: 10050, Installer: "com.android.vending"},
+		{Name: "com.example.todo", Uid: 10051, Installer: "com.android.vending"},
+		{Name: "com.example.game", Uid: 10052},
+	})
+
+	g := db.GroupByInstaller()
+	assert(len(g) == 2, t, fmt.Sprintf("expected 2 installers, saw %d", len(g)))
+
+	pv := g["com.android.vending"]
+	assert(len(pv) == 2, t, fmt.Sprintf("expected 2 pkgs for vending, saw %d", len(pv)))
+	assert(pv[0].Name == "com.example.notes" && pv[1].Name == "com.example.todo", t, "vending group not sorted")
+
+	pv = g[""]
+	assert(len(pv) == 1 && pv[0].Name == "com.example.game", t, "wrong sideloaded group")
+}
+
+func TestDuplicateUids(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/dupuid.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(db.GetListByUid(1000)) == 2, t, "expected 2 pkgs for the system uid")
+
+	d := db.DuplicateUids()
+	assert(len(d) == 1, t, fmt.Sprintf("expected 1 duplicate uid, saw %d", len(d)))
+
+	pv := d[10050]
+	assert(len(pv) == 2, t, fmt.Sprintf("expected 2 pkgs for uid 10050, saw %d", len(pv)))
+	assert(pv[0].Name == "com.example.evil" && pv[1].Name == "com.example.notes", t, "wrong pkgs for uid 10050")
+
+	db, err = pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(db.DuplicateUids()) == 0, t, "duplicate uids in the clean fixture")
+}
+
+func TestOpenReaders(t *testing.T) {
+	l0 := "com.example.notes 10050 0 /data/user/0/com.example.notes default 3003\n" +
+		"com.example.todo 10051 1 /data/user/0/com.example.todo default none\n"
+	l1 := "com.example.todo 10061 0 /data/user/10/com.example.todo default none\n" +
+		"com.example.game 10052 0 /data/user/0/com.example.game default none\n"
+
+	db, err := pkg.OpenPackageDBReaders(nil, []io.Reader{strings.NewReader(l0), strings.NewReader(l1)}, pkg.WithSelf(false))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(db.Len() == 3, t, fmt.Sprintf("expected 3 pkgs, saw %d", db.Len()))
+
+	p := db.GetByName("com.example.todo")
+	assert(p.Uid == 10061 && p.DataPath == "/data/user/10/com.example.todo" && !p.Debug, t,
+		fmt.Sprintf("later list didn't win: %s", p))
+	assert(db.GetByName("com.example.notes").Uid == 10050, t, "lost com.example.notes")
+	assert(db.GetByName("com.example.game").Uid == 10052, t, "lost com.example.game")
+
+	w := db.Warnings()
+	assert(len(w) == 1 && strings.Contains(w[0], "com.example.todo") && strings.HasPrefix(w[0], "packages.list[1]"), t,
+		fmt.Sprintf("wrong warnings %q", w))
+
+	// the xml fragments are merged the same way
+	x0, err := os.Open("testdata/packages.xml")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	defer x0.Close()
+	x1, err := os.Open("testdata/reason.xml")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	defer x1.Close()
+
+	db, err = pkg.OpenPackageDBReaders([]io.Reader{x0, x1}, []io.Reader{strings.NewReader(l0)})
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(db.Warnings()) == 0, t, fmt.Sprintf("unexpected warnings %q", db.Warnings()))
+
+	p = db.GetByName("com.example.notes")
+	assert(p.InstallReason == pkg.InstallReasonUser && p.Gid[0] == 3003, t, fmt.Sprintf("wrong merged pkg %s", p))
+	assert(db.GetByName("com.example.game") != nil, t, "lost com.example.game")
+	assert(db.GetByName("com.android.providers.telephony").Cert != nil, t, "lost com.android.providers.telephony")
+}
+
+func TestOpenReadersLenient(t *testing.T) {
+	l0 := "com.example.notes 10050 0 /data/user/0/com.example.notes default 3003\n" +
+		"com.example.bad 1005x 0 /data/user/0/com.example.bad default none\n"
+	x0, err := os.ReadFile("testdata/baduid.xml")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	_, err = pkg.OpenPackageDBReaders(nil, []io.Reader{strings.NewReader(""), strings.NewReader(l0)})
+	assert(err != nil, t, "strict mode accepted a malformed line")
+
+	db, err := pkg.OpenPackageDBReaders([]io.Reader{bytes.NewReader(x0)},
+		[]io.Reader{strings.NewReader(""), strings.NewReader(l0)}, pkg.WithStrict(false))
+	var pe *pkg.ParseError
+	assert(errors.As(err, &pe) && pe.File == "packages.list[1]" && pe.Line == 2, t, fmt.Sprintf("wrong error %v", err))
+	assert(strings.Contains(err.Error(), "packages.xml: com.example.notes"), t, fmt.Sprintf("lost the xml error: %v", err))
+	assert(db.GetByName("com.example.notes").Path == "", t, "kept the package with a bad uid")
+	assert(db.GetByName("com.example.bad") == nil, t, "kept com.example.bad")
+}
+
+func TestOpenReadersKeySets(t *testing.T) {
+	open := func(fn ...string) (*pkg.PackageDB, error) {
+		var v []io.Reader
+		for _, f := range fn {
+			b, err := os.ReadFile(f)
+			assert(err == nil, t, fmt.Sprintf("%s", err))
+			v = append(v, bytes.NewReader(b))
+		}
+		return pkg.OpenPackageDBReaders(v, nil)
+	}
+
+	// the same keysets in both sources are fine
+	db, err := open("testdata/keyset.xml", "testdata/keyset.xml")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(db.KeySets()) == 2, t, fmt.Sprintf("expected 2 keysets, saw %d", len(db.KeySets())))
+
+	// keyset 1 has a different key in each; the later one wins
+	db, err = open("testdata/keyset.xml", "testdata/keyset2.xml")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	ks := db.KeySets()
+	assert(len(ks) == 2 && bytes.Equal(ks[0].Keys[0], ks[1].Keys[0]), t, fmt.Sprintf("wrong keysets %v", ks))
+
+	w := db.Warnings()
+	assert(len(w) == 1 && strings.Contains(w[0], "packages.xml[1]: keyset 1"), t, fmt.Sprintf("wrong warnings %q", w))
+}
+
+func TestPreinstalled(t *testing.T) {
+	tests := []struct {
+		path    string
+		priv    bool
+		preinst bool
+	}{
+		{"/system/priv-app/Settings", true, true},
+		{"/product/priv-app/GmsCore", true, true},
+		{"/system/app/Bluetooth", false, true},
+		{"/system/framework/framework-res.apk", false, true},
+		{"/vendor/app/Qmmi", false, true},
+		{"/data/app/com.example.notes-1", false, false},
+		{"/data/app/~~Xy1bK2Qd8w==/com.example.notes-1", false, false},
+		{"/systemx/priv-app/Evil", false, false},
+		{"", false, false},
+	}
+
+	for _, x := range tests {
+		p := &pkg.Pkg{Name: "com.example", Path: x.path}
+		assert(p.IsPrivileged() == x.priv, t, fmt.Sprintf("%q: wrong privileged %v", x.path, p.IsPrivileged()))
+		assert(p.IsPreinstalled() == x.preinst, t, fmt.Sprintf("%q: wrong preinstalled %v", x.path, p.IsPreinstalled()))
+	}
+}
+
+func TestWriteJSONL(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/packages.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	var b bytes.Buffer
+	assert(db.WriteJSONL(&b) == nil, t, "write jsonl failed")
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	assert(len(lines) == 3, t, fmt.Sprintf("expected 3 lines, saw %d", len(lines)))
+
+	var prev string
+	for _, l := range lines {
+		var v map[string]any
+		assert(json.Unmarshal([]byte(l), &v) == nil, t, fmt.Sprintf("bad line %q", l))
+
+		nm := v["name"].(string)
+		assert(prev < nm, t, fmt.Sprintf("unsorted: %s after %s", nm, prev))
+		prev = nm
+
+		j, err := json.Marshal(db.GetByName(nm))
+		assert(err == nil, t, fmt.Sprintf("%s", err))
+		assert(string(j) == l, t, fmt.Sprintf("%s: line differs from MarshalJSON: %q", nm, l))
+	}
+}
+
+func TestDebugSigned(t *testing.T) {
+	db, err := pkg.OpenPackageDB("testdata/debugkey.xml", "testdata/packages.list")
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	assert(db.GetByName("com.example.notes").IsDebugSigned(), t, "debug key not detected")
+	assert(!db.GetByName("com.example.todo").IsDebugSigned(), t, "release key is a debug key")
+	assert(!db.GetByName("com.example.game").IsDebugSigned(), t, "unsigned package is debug signed")
+
+	pv := db.DebugSignedPackages()
+	assert(len(pv) == 1 && pv[0].Name == "com.example.notes", t, fmt.Sprintf("wrong debug signed pkgs %v", pv))
+
+	// the lazily parsed certs are checked the same way
+	db, err = pkg.OpenPackageDB("testdata/debugkey.xml", "testdata/packages.list", pkg.WithLazyCerts(true))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+	assert(len(db.DebugSignedPackages()) == 1, t, "lazy debug key not detected")
+}
+
+func TestFieldSplitter(t *testing.T) {
+	xml, list := "testdata/packages.xml", "testdata/tabs.list"
+
+	db, err := pkg.OpenPackageDB(xml, list, pkg.WithFieldSplitter(pkg.SplitTabs))
+	assert(err == nil, t, fmt.Sprintf("%s", err))
+
+	p := db.GetByName("com.example.notes")
+	assert(p.DataPath == "/mnt/expand/My Card/user/0/com.example.notes", t, fmt.Sprintf("wrong data path %q", p.DataPath))
+	assert(p.Uid == 10050 && p.SEinfo == "default" && slices.Equal(p.Gid, []uint32{3003}), t, fmt.Sprintf("wrong pkg %s", p))
+	assert(db.GetByName("com.example.todo").Debug, t, "lost com.example.todo")
+	assert(len(db.GetByName("com.android.providers.telephony").Gid) == 3, t, "wrong gids for telephony")
+
+	// the default whitespace split trips over the space in the path
+	_, err = pkg.OpenPackageDB(xml, list)
+	var pe *pkg.ParseError
+	assert(errors.As(err, &pe) && pe.Line == 2, t, fmt.Sprintf("default splitter accepted the tabs fixture: %v", err))
+}
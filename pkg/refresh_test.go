@@ -0,0 +1,121 @@
+// refresh_test.go -- internal tests for the refresh trigger
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRefreshClock(t *testing.T) {
+	dir := t.TempDir()
+	xml := filepath.Join(dir, "packages.xml")
+	list := filepath.Join(dir, "packages.list")
+	for _, fn := range []string{"packages.xml", "packages.list"} {
+		if err := os.WriteFile(filepath.Join(dir, fn), readFixture(t, "testdata/"+fn), 0600); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	// files written well before the DB was loaded
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mtime := func(fn string, tm time.Time) {
+		if err := os.Chtimes(fn, tm, tm); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	mtime(xml, t0)
+	mtime(list, t0)
+
+	now := t0.Add(time.Hour)
+	db := newDB(nil)
+	db.list = list
+	db.xml = xml
+	db.now = func() time.Time { return now }
+
+	if err := db.refresh(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !db.LastUpdate().Equal(now) {
+		t.Fatalf("wrong last update %s; exp %s", db.LastUpdate(), now)
+	}
+
+	// an older mtime doesn't trigger a reload
+	mtime(list, now.Add(-time.Minute))
+	if db.stale() {
+		t.Fatalf("older mtime made the DB stale")
+	}
+	p := db.GetByName("com.example.notes")
+	if db.GetByName("com.example.notes") != p {
+		t.Fatalf("older mtime reloaded the DB")
+	}
+
+	// a newer one does
+	mtime(list, now.Add(time.Minute))
+	if !db.stale() {
+		t.Fatalf("newer mtime didn't make the DB stale")
+	}
+	now = now.Add(2 * time.Minute)
+	if db.GetByName("com.example.notes") == p {
+		t.Fatalf("newer mtime didn't reload the DB")
+	}
+	if !db.LastUpdate().Equal(now) {
+		t.Fatalf("wrong last update %s; exp %s", db.LastUpdate(), now)
+	}
+	if db.stale() {
+		t.Fatalf("DB is stale after reload")
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	db := newDB([]Option{WithSelf(false)})
+	db.list = "testdata/packages.list"
+	db.xml = "testdata/packages.xml"
+	db.now = func() time.Time { return now }
+	db.noAuto = true
+
+	if err := db.refresh(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	now = now.Add(90 * time.Second)
+
+	var b bytes.Buffer
+	if err := db.WritePrometheus(&b); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	exp := `# HELP android_packages_total Packages in the DB.
+# TYPE android_packages_total gauge
+android_packages_total 3
+# HELP android_packages_with_cert Packages with a signing cert.
+# TYPE android_packages_with_cert gauge
+android_packages_with_cert 2
+# HELP android_shared_uids Distinct sharedUserIds.
+# TYPE android_shared_uids gauge
+android_shared_uids 1
+# HELP android_cert_failures Packages whose certs couldn't be decoded.
+# TYPE android_cert_failures gauge
+android_cert_failures 0
+# HELP android_db_age_seconds Seconds since the DB was last refreshed.
+# TYPE android_db_age_seconds gauge
+android_db_age_seconds 90
+`
+	if b.String() != exp {
+		t.Fatalf("wrong metrics:\n%s\nexp:\n%s", b.String(), exp)
+	}
+}
@@ -0,0 +1,98 @@
+// snapshot.go -- immutable copies of the package DB
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"maps"
+	"slices"
+)
+
+// Return a consistent copy of the DB that never changes: it has no
+// backing files and is never refreshed. The Pkg values in a snapshot
+// are independent copies; changes to them (or to the original DB)
+// don't affect each other. The parsed x509 certificates are shared
+// since they are never modified.
+func (db *PackageDB) Snapshot() *PackageDB {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	byName := make(map[string]*Pkg, len(db.byName))
+	for nm, p := range db.byName {
+		byName[nm] = p.clone()
+	}
+
+	xx := &xmlDB{
+		hdr:      db.hdr,
+		shared:   maps.Clone(db.shared),
+		updated:  maps.Clone(db.updated),
+		renamed:  maps.Clone(db.renamed),
+		warn:     slices.Clone(db.warn),
+		orphans:  slices.Clone(db.orphans),
+		keysets:  maps.Clone(db.keysets),
+		certErrs: slices.Clone(db.stats.CertErrors),
+		took:     db.stats.LastParseDuration,
+	}
+
+	users := make(map[int]map[string]UserState, len(db.users))
+	for u, m := range db.users {
+		users[u] = maps.Clone(m)
+	}
+
+	grants := make(map[int]*userGrants, len(db.grants))
+	for u, g := range db.grants {
+		grants[u] = g.clone()
+	}
+
+	snap := &PackageDB{
+		cfg:    db.cfg,
+		now:    db.now,
+		noAuto: true,
+		users:  users,
+		grants: grants,
+	}
+	db.mu.RUnlock()
+
+	snap.install(byName, xx)
+	return snap
+}
+
+// Return a deep copy of p
+func (p *Pkg) clone() *Pkg {
+	q := *p
+
+	q.Gid = slices.Clone(p.Gid)
+	q.Certhash = slices.Clone(p.Certhash)
+	q.Certhash256 = slices.Clone(p.Certhash256)
+	q.CertDER = slices.Clone(p.CertDER)
+	q.Certs = slices.Clone(p.Certs)
+	q.certs = slices.Clone(p.certs)
+	q.lineage = slices.Clone(p.lineage)
+	q.SigningLineage = slices.Clone(p.SigningLineage)
+	q.SignatureSchemes = slices.Clone(p.SignatureSchemes)
+	q.KeySetAliases = maps.Clone(p.KeySetAliases)
+	q.Splits = slices.Clone(p.Splits)
+	q.DisabledComponents = slices.Clone(p.DisabledComponents)
+	q.EnabledComponents = slices.Clone(p.EnabledComponents)
+	q.Permissions = slices.Clone(p.Permissions)
+
+	q.CertHashes = make([][]byte, len(p.CertHashes))
+	for i, h := range p.CertHashes {
+		q.CertHashes[i] = slices.Clone(h)
+	}
+	if p.CertHashes == nil {
+		q.CertHashes = nil
+	}
+	return &q
+}
@@ -0,0 +1,107 @@
+// stats.go -- counters from the last parse
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Counters describing the DB as of its last refresh
+type Stats struct {
+	// packages in the DB
+	PackageCount int
+
+	// packages with a signing cert
+	CertCount int
+
+	// distinct sharedUserIds used by the packages
+	SharedUidCount int
+
+	// packages whose certs couldn't be decoded in lenient mode (see
+	// OpenPackageDBStrict); a non-zero count usually means a corrupt
+	// packages.xml
+	CertFailures int
+
+	// the *ParseError for each of the CertFailures; these packages
+	// are in the DB but have no certs
+	CertErrors []error
+
+	// time taken to read and parse packages.xml and packages.list
+	LastParseDuration time.Duration
+}
+
+// Return the counters from the last refresh
+func (db *PackageDB) Stats() Stats {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	st := db.stats
+	st.CertErrors = slices.Clone(st.CertErrors)
+	return st
+}
+
+// Write the counters from the last refresh to 'w' as Prometheus
+// gauges in the text exposition format.
+func (db *PackageDB) WritePrometheus(w io.Writer) error {
+	st := db.Stats()
+	last := db.LastUpdate()
+
+	bw := bufio.NewWriter(w)
+	gauge := func(nm, help string, v string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", nm, help, nm, nm, v)
+	}
+
+	gauge("android_packages_total", "Packages in the DB.", strconv.Itoa(st.PackageCount))
+	gauge("android_packages_with_cert", "Packages with a signing cert.", strconv.Itoa(st.CertCount))
+	gauge("android_shared_uids", "Distinct sharedUserIds.", strconv.Itoa(st.SharedUidCount))
+	gauge("android_cert_failures", "Packages whose certs couldn't be decoded.", strconv.Itoa(st.CertFailures))
+
+	// an empty DB has no age
+	if !last.IsZero() {
+		age := db.clock().Sub(last).Seconds()
+		gauge("android_db_age_seconds", "Seconds since the DB was last refreshed.", strconv.FormatFloat(age, 'g', -1, 64))
+	}
+	return bw.Flush()
+}
+
+// Compute the counters for 'byName'; 'xx' has the ones only known
+// while parsing.
+func makeStats(byName map[string]*Pkg, xx *xmlDB) Stats {
+	st := Stats{
+		PackageCount:      len(byName),
+		CertFailures:      len(xx.certErrs),
+		CertErrors:        xx.certErrs,
+		LastParseDuration: xx.took,
+	}
+
+	shared := make(map[uint32]bool)
+	for _, p := range byName {
+		if p.hasCert() {
+			st.CertCount++
+		}
+		if p.SharedUid > 0 {
+			shared[p.SharedUid] = true
+		}
+	}
+	st.SharedUidCount = len(shared)
+	return st
+}
@@ -0,0 +1,111 @@
+// storage.go -- where a package is installed
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// The kind of storage a package is installed on
+type StorageType int
+
+const (
+	StorageUnknown  StorageType = iota
+	StorageInternal             // /data/app, /system/app etc.
+	StorageExternal             // SD card: /mnt/asec, /storage
+	StorageAdopted              // adopted SD card: /mnt/expand/<uuid>
+)
+
+func (s StorageType) String() string {
+	switch s {
+	case StorageInternal:
+		return "internal"
+	case StorageExternal:
+		return "external"
+	case StorageAdopted:
+		return "adopted"
+	default:
+		return "unknown"
+	}
+}
+
+// Volume uuids that aren't uuids; the names mirror StorageManager
+const (
+	VolumeInternal        = ""                 // the internal /data partition
+	VolumePrimaryPhysical = "primary_physical" // the legacy external SD card
+)
+
+// Return the packages installed on the volume 'uuid', sorted by name.
+// VolumeInternal and VolumePrimaryPhysical must match exactly; the
+// uuids of adopted volumes (/mnt/expand/<uuid>) match regardless of
+// case.
+func (db *PackageDB) GetByVolumeUuid(uuid string) []*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	match := func(v string) bool {
+		if v == VolumePrimaryPhysical || uuid == VolumePrimaryPhysical {
+			return v == uuid
+		}
+		return strings.EqualFold(v, uuid)
+	}
+
+	var pv []*Pkg
+	for _, p := range db.byName {
+		if !p.pseudo && match(p.VolumeUuid) {
+			pv = append(pv, p)
+		}
+	}
+
+	sort.Slice(pv, func(i, j int) bool {
+		return pv[i].Name < pv[j].Name
+	})
+	return pv
+}
+
+// Top level dirs of the internal storage partitions
+var internalDirs = []string{"/data", "/system", "/vendor", "/product", "/oem", "/odm", "/apex"}
+
+// Return the kind of storage the package is installed on; this is
+// inferred from its code path.
+func (p *Pkg) StorageType() StorageType {
+	if len(p.Path) == 0 {
+		return StorageUnknown
+	}
+
+	cp := path.Clean(p.Path)
+	switch {
+	case under(cp, "/mnt/expand"):
+		return StorageAdopted
+	case under(cp, "/mnt/asec"), under(cp, "/mnt/sdcard"), under(cp, "/storage"), under(cp, "/sdcard"):
+		return StorageExternal
+	}
+
+	for _, d := range internalDirs {
+		if under(cp, d) {
+			return StorageInternal
+		}
+	}
+	return StorageUnknown
+}
+
+// Return true if 'p' is strictly below directory 'dir'
+func under(p, dir string) bool {
+	return strings.HasPrefix(p, dir+"/")
+}
@@ -0,0 +1,104 @@
+// uid.go -- classify uids by their range
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"sort"
+)
+
+// The kind of uid a package runs as
+type UidClass int
+
+const (
+	UidUnknown         UidClass = iota
+	UidSystem                   // app id below 10000: system services
+	UidApp                      // app id 10000-19999: regular apps
+	UidSdkSandbox               // app id 20000-29999: SDK runtime sandboxes
+	UidIsolatedProcess          // app id 90000-99999: isolated and app zygote processes
+	UidShared                   // a sharedUserId
+)
+
+// App id ranges from android.os.Process
+const (
+	firstAppId        = 10000
+	lastAppId         = 19999
+	firstSdkSandboxId = 20000
+	lastSdkSandboxId  = 29999
+	firstIsolatedId   = 90000
+	lastIsolatedId    = 99999
+)
+
+func (c UidClass) String() string {
+	switch c {
+	case UidSystem:
+		return "system"
+	case UidApp:
+		return "app"
+	case UidSdkSandbox:
+		return "sdk-sandbox"
+	case UidIsolatedProcess:
+		return "isolated"
+	case UidShared:
+		return "shared"
+	default:
+		return "unknown"
+	}
+}
+
+// Return the class of the package's uid; packages with a sharedUserId
+// are UidShared regardless of the uid range.
+func (p *Pkg) UidClass() UidClass {
+	if p.IsShared() {
+		return UidShared
+	}
+
+	switch id := p.AppID(); {
+	case id < firstAppId:
+		return UidSystem
+	case id <= lastAppId:
+		return UidApp
+	case id >= firstSdkSandboxId && id <= lastSdkSandboxId:
+		return UidSdkSandbox
+	case id >= firstIsolatedId && id <= lastIsolatedId:
+		return UidIsolatedProcess
+	}
+	return UidUnknown
+}
+
+// Return all packages whose uid is of class 'c' sorted by uid and
+// then by name
+func (db *PackageDB) GetByUidClass(c UidClass) []*Pkg {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var pv []*Pkg
+	for _, v := range db.byUid {
+		for _, p := range v {
+			if p.UidClass() == c {
+				pv = append(pv, p)
+			}
+		}
+	}
+
+	sort.Slice(pv, func(i, j int) bool {
+		if pv[i].Uid != pv[j].Uid {
+			return pv[i].Uid < pv[j].Uid
+		}
+		return pv[i].Name < pv[j].Name
+	})
+	return pv
+}
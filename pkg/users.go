@@ -0,0 +1,286 @@
+// users.go -- per-user package state on multi-user devices
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// Values of the "enabled" attribute in package-restrictions.xml;
+// these mirror PackageManager.COMPONENT_ENABLED_STATE_xxx.
+const (
+	EnabledStateDefault          = 0
+	EnabledStateEnabled          = 1
+	EnabledStateDisabled         = 2
+	EnabledStateDisabledUser     = 3
+	EnabledStateDisabledUntilUse = 4
+)
+
+// Each device user gets its own range of this many uids
+const PerUserRange = 100000
+
+// Return the device user the package belongs to
+func (p *Pkg) UserID() int {
+	return int(p.Uid / PerUserRange)
+}
+
+// Return the user independent app id of the package
+func (p *Pkg) AppID() uint32 {
+	return p.Uid % PerUserRange
+}
+
+// Return all packages belonging to device user 'userID' sorted by uid
+// and then by name
+func (db *PackageDB) GetByUserID(userID int) []*Pkg {
+	if userID < 0 {
+		return nil
+	}
+
+	lo := uint64(userID) * PerUserRange
+	hi := lo + PerUserRange - 1
+	if hi > math.MaxUint32 {
+		return nil
+	}
+	return db.GetByUidRange(uint32(lo), uint32(hi))
+}
+
+// State of a package for one user, from that user's
+// package-restrictions.xml
+type UserState struct {
+	Enabled   int // one of EnabledStateXXX
+	Hidden    bool
+	Stopped   bool
+	Installed bool
+}
+
+// package-restrictions.xml top level struct
+type xRestrictions struct {
+	XMLName xml.Name        `xml:"package-restrictions"`
+	Pkgs    []xRestrictsPkg `xml:"pkg"`
+}
+
+type xRestrictsPkg struct {
+	Name    string `xml:"name,attr"`
+	Enabled string `xml:"enabled,attr"`
+	Hidden  bool   `xml:"hidden,attr"`
+	Stopped bool   `xml:"stopped,attr"`
+	Inst    string `xml:"inst,attr"`
+}
+
+// Parse /data/system/users/<userID>/package-restrictions.xml at 'fn'
+// and record the state of each package for that user. The state
+// survives refreshes of the DB; loading the same user again replaces
+// its state.
+func (db *PackageDB) LoadUserRestrictions(userID int, fn string) error {
+	fd, err := db.open(fn)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	ifd, err := gunzip(fd)
+	if err != nil {
+		return &ParseError{File: fn, Err: err}
+	}
+
+	var v xRestrictions
+	if err := xml.NewDecoder(ifd).Decode(&v); err != nil {
+		return &ParseError{File: fn, Err: err}
+	}
+
+	m := make(map[string]UserState)
+	for _, x := range v.Pkgs {
+		st := UserState{
+			Hidden:    x.Hidden,
+			Stopped:   x.Stopped,
+			Installed: x.Inst != "false",
+		}
+
+		if len(x.Enabled) > 0 {
+			if st.Enabled, err = strconv.Atoi(x.Enabled); err != nil {
+				return &ParseError{File: fn, Package: x.Name,
+					Err: fmt.Errorf("Cannot parse enabled <%s>: %w", x.Enabled, err)}
+			}
+		}
+		m[x.Name] = st
+	}
+
+	db.mu.Lock()
+	if db.users == nil {
+		db.users = make(map[int]map[string]UserState)
+	}
+	db.users[userID] = m
+	db.mu.Unlock()
+	return nil
+}
+
+// Return the state of the package for user 'userID'. The second
+// return value is false if no restrictions were loaded for the package
+// and user, in which case the state is the default.
+func (p *Pkg) UserState(userID int) (UserState, bool) {
+	def := UserState{Installed: true}
+	if p.db == nil {
+		return def, false
+	}
+
+	p.db.mu.RLock()
+	defer p.db.mu.RUnlock()
+
+	if st, ok := p.db.users[userID][p.Name]; ok {
+		return st, true
+	}
+	return def, false
+}
+
+// Return true if the package is usable by user 'userID': installed
+// for the user, not disabled and not hidden. Packages are enabled for
+// users whose restrictions haven't been loaded.
+func (p *Pkg) EnabledForUser(userID int) bool {
+	st, _ := p.UserState(userID)
+
+	switch st.Enabled {
+	case EnabledStateDisabled, EnabledStateDisabledUser, EnabledStateDisabledUntilUse:
+		return false
+	}
+	return st.Installed && !st.Hidden
+}
+
+// runtime-permissions.xml top level struct
+type xRuntimePerms struct {
+	XMLName xml.Name      `xml:"runtime-permissions"`
+	Pkgs    []xRuntimePkg `xml:"pkg"`
+	Shared  []xRuntimePkg `xml:"shared-user"`
+}
+
+type xRuntimePkg struct {
+	Name  string  `xml:"name,attr"`
+	Perms []xperm `xml:"item"`
+}
+
+// Runtime permissions granted to one user
+type userGrants struct {
+	pkgs   map[string][]string // package name -> permissions
+	shared map[string][]string // shared user name -> permissions
+}
+
+func (g *userGrants) clone() *userGrants {
+	return &userGrants{
+		pkgs:   maps.Clone(g.pkgs),
+		shared: maps.Clone(g.shared),
+	}
+}
+
+// Parse /data/system/users/<userID>/runtime-permissions.xml at 'fn'
+// and record the runtime permissions granted to each package for that
+// user (Android 6 and later keep them out of packages.xml). Packages
+// and shared users unknown to the DB are ignored and noted in
+// Warnings() until the next refresh. The permissions survive refreshes
+// of the DB; loading the same user again replaces them.
+func (db *PackageDB) LoadRuntimePermissions(userID int, fn string) error {
+	fd, err := db.open(fn)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	ifd, err := gunzip(fd)
+	if err != nil {
+		return &ParseError{File: fn, Err: err}
+	}
+
+	var v xRuntimePerms
+	if err := xml.NewDecoder(ifd).Decode(&v); err != nil {
+		return &ParseError{File: fn, Err: err}
+	}
+
+	g := &userGrants{
+		pkgs:   make(map[string][]string),
+		shared: make(map[string][]string),
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, x := range v.Pkgs {
+		if _, ok := db.byName[x.Name]; !ok {
+			db.warn = append(db.warn, fmt.Sprintf("%s: unknown package %s", fn, x.Name))
+			continue
+		}
+		g.pkgs[x.Name] = grantedPerms(x.Perms)
+	}
+
+	shared := make(map[string]bool, len(db.shared))
+	for _, nm := range db.shared {
+		shared[nm] = true
+	}
+	for _, x := range v.Shared {
+		if !shared[x.Name] {
+			db.warn = append(db.warn, fmt.Sprintf("%s: unknown shared user %s", fn, x.Name))
+			continue
+		}
+		g.shared[x.Name] = grantedPerms(x.Perms)
+	}
+
+	if db.grants == nil {
+		db.grants = make(map[int]*userGrants)
+	}
+	db.grants[userID] = g
+	return nil
+}
+
+// Return the sorted runtime permissions granted to the package for
+// user 'userID', including those granted to its shared user; nil if
+// none were loaded (see LoadRuntimePermissions()).
+func (p *Pkg) GrantedPermissions(userID int) []string {
+	if p.db == nil {
+		return nil
+	}
+
+	p.db.mu.RLock()
+	defer p.db.mu.RUnlock()
+
+	g, ok := p.db.grants[userID]
+	if !ok {
+		return nil
+	}
+
+	v := slices.Clone(g.pkgs[p.Name])
+	if p.SharedUid > 0 {
+		v = append(v, g.shared[p.db.shared[p.SharedUid]]...)
+	}
+	if len(v) == 0 {
+		return nil
+	}
+
+	slices.Sort(v)
+	return slices.Compact(v)
+}
+
+// Return the names of the permissions in 'v' that are granted;
+// permissions are granted unless explicitly revoked.
+func grantedPerms(v []xperm) []string {
+	var r []string
+	for _, pm := range v {
+		if pm.Granted != "false" {
+			r = append(r, pm.Name)
+		}
+	}
+	return r
+}
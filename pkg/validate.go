@@ -0,0 +1,129 @@
+// validate.go -- sanity checks for a loaded package DB
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// Check the invariants of the DB and return an error describing
+// every violation; nil if there are none. This catches truncated or
+// tampered packages.xml files:
+//
+//   - every package has a non-zero uid
+//   - no two packages have the same code path
+//   - the cert hashes match the certs
+//   - packages that share a uid are signed by the same key, and the
+//     uid is a declared shared user (if packages.xml declares any)
+func (db *PackageDB) Validate() error {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	pv := sortedPkgs(db.byName)
+	shared := db.shared
+	byUid := db.byUid
+	db.mu.RUnlock()
+
+	var errs []error
+	paths := make(map[string]string)
+	for _, p := range pv {
+		if p.pseudo {
+			continue
+		}
+
+		if p.Uid == 0 {
+			errs = append(errs, fmt.Errorf("%s: uid is zero", p.Name))
+		}
+
+		if len(p.Path) > 0 {
+			cp := path.Clean(p.Path)
+			if nm, ok := paths[cp]; ok {
+				errs = append(errs, fmt.Errorf("%s: code path %s also used by %s", p.Name, cp, nm))
+			} else {
+				paths[cp] = p.Name
+			}
+		}
+
+		errs = append(errs, p.validateCerts()...)
+	}
+
+	uids := make([]uint32, 0, len(byUid))
+	for uid, v := range byUid {
+		if len(v) > 1 {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] < uids[j]
+	})
+
+	for _, uid := range uids {
+		v := byUid[uid]
+		if _, ok := shared[uid]; !ok && len(shared) > 0 {
+			errs = append(errs, fmt.Errorf("uid %d: shared by %d packages but not a declared shared user", uid, len(v)))
+		}
+
+		for _, p := range v[1:] {
+			if v[0].hasCert() && p.hasCert() && !v[0].SameSigner(p) {
+				errs = append(errs, fmt.Errorf("uid %d: %s and %s have different signers", uid, v[0].Name, p.Name))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Verify that the cert hashes of p are those of its certs
+func (p *Pkg) validateCerts() []error {
+	var errs []error
+
+	certs, _ := p.certDERs()
+	if len(certs) != len(p.CertHashes) {
+		errs = append(errs, fmt.Errorf("%s: %d certs but %d cert hashes", p.Name, len(certs), len(p.CertHashes)))
+		return errs
+	}
+
+	for i, der := range certs {
+		h := sha1.Sum(der)
+		if !bytes.Equal(h[:], p.CertHashes[i]) {
+			errs = append(errs, fmt.Errorf("%s: cert %d doesn't match its hash", p.Name, i))
+		}
+	}
+
+	der := p.CertDER
+	if p.Cert != nil {
+		der = p.Cert.Raw
+	}
+	if len(der) == 0 {
+		return errs
+	}
+
+	h := sha1.Sum(der)
+	if !bytes.Equal(h[:], p.Certhash) {
+		errs = append(errs, fmt.Errorf("%s: cert doesn't match its hash", p.Name))
+	}
+
+	h2 := sha256.Sum256(der)
+	if !bytes.Equal(h2[:], p.Certhash256) {
+		errs = append(errs, fmt.Errorf("%s: cert doesn't match its sha256 hash", p.Name))
+	}
+	return errs
+}
@@ -0,0 +1,84 @@
+// watch.go -- push notifications when the package DB changes
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// How often we poll the backing files when we can't get notified
+var pollInterval = 2 * time.Second
+
+var errNoFiles = errors.New("package DB has no backing files")
+
+// Watch the backing files for changes; on every change, the DB is
+// refreshed and, if that succeeds, a value is sent on the returned
+// channel. Signals are coalesced: a slow reader sees one pending
+// signal no matter how many reloads happened. The channel is closed
+// when ctx is cancelled.
+//
+// Watch uses inotify where available and falls back to polling the
+// file modification times.
+func (db *PackageDB) Watch(ctx context.Context) (<-chan struct{}, error) {
+	if !db.hasFiles() {
+		return nil, errNoFiles
+	}
+
+	ch := make(chan struct{}, 1)
+
+	// files inside an fs.FS can only be polled
+	if db.fsys == nil {
+		if err := db.notify(ctx, ch); err == nil {
+			return ch, nil
+		}
+	}
+
+	go db.poll(ctx, ch)
+	return ch, nil
+}
+
+// Reload the DB and let the watcher know
+func (db *PackageDB) reload(ch chan struct{}) {
+	if err := db.refresh(); err != nil {
+		return
+	}
+
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Poll the backing files every pollInterval
+func (db *PackageDB) poll(ctx context.Context, ch chan struct{}) {
+	defer close(ch)
+
+	tick := time.NewTicker(pollInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-tick.C:
+			if db.stale() {
+				db.reload(ch)
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// watch_linux.go -- inotify based watcher for Linux+Android
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build android || linux
+// +build android linux
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// Android rewrites packages.xml by renaming a new file over it; so we
+// watch the containing directories rather than the files themselves.
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE
+
+// Start an inotify watch on the backing files and reload the DB
+// whenever they change.
+func (db *PackageDB) notify(ctx context.Context, ch chan struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+
+	names := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, fn := range []string{db.list, db.xml} {
+		if len(fn) == 0 {
+			continue
+		}
+		names[filepath.Base(fn)] = true
+		dirs[filepath.Dir(fn)] = true
+	}
+
+	for d := range dirs {
+		if _, err := syscall.InotifyAddWatch(fd, d, inotifyMask); err != nil {
+			syscall.Close(fd)
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+	}
+
+	// A non-blocking fd goes to the runtime poller; closing it
+	// unblocks the reader below.
+	fp := os.NewFile(uintptr(fd), "inotify")
+
+	go func() {
+		<-ctx.Done()
+		fp.Close()
+	}()
+
+	go func() {
+		defer close(ch)
+
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := fp.Read(buf)
+			if err != nil {
+				return
+			}
+
+			if changed(buf[:n], names) {
+				db.reload(ch)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Return true if any of the inotify events in 'b' is for a file in
+// 'names'
+func changed(b []byte, names map[string]bool) bool {
+	for len(b) >= syscall.SizeofInotifyEvent {
+		ev := (*syscall.InotifyEvent)(unsafe.Pointer(&b[0]))
+		end := syscall.SizeofInotifyEvent + int(ev.Len)
+		if end > len(b) {
+			break
+		}
+
+		nm := b[syscall.SizeofInotifyEvent:end]
+		if i := bytes.IndexByte(nm, 0); i >= 0 {
+			nm = nm[:i]
+		}
+		if names[string(nm)] {
+			return true
+		}
+		b = b[end:]
+	}
+	return false
+}
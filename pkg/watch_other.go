@@ -0,0 +1,28 @@
+// watch_other.go -- watcher for OSes without inotify
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !android && !linux
+// +build !android,!linux
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"context"
+	"errors"
+)
+
+// No inotify here; the caller falls back to polling.
+func (db *PackageDB) notify(ctx context.Context, ch chan struct{}) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,355 @@
+// write.go -- serialize a PackageDB back to the Android formats
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Write the DB to 'w' in packages.list format; packages are sorted by
+// name. Packages without a data directory (i.e., those only known from
+// packages.xml) are skipped.
+func (db *PackageDB) WriteList(w io.Writer) error {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	pv := sortedPkgs(db.byName)
+	db.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, p := range pv {
+		if len(p.DataPath) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(bw, "%s %d %s %s %s %s", p.Name, p.Uid, listDebug(p.Debug),
+			p.DataPath, listStr(p.SEinfo, "default"), listGids(p.Gid))
+		if len(p.SEinfoUser) > 0 {
+			fmt.Fprintf(bw, " %s", p.SEinfoUser)
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+func listDebug(d bool) string {
+	if d {
+		return "1"
+	}
+	return "0"
+}
+
+func listStr(s, def string) string {
+	if len(s) == 0 {
+		return def
+	}
+	return s
+}
+
+func listGids(gid []uint32) string {
+	if len(gid) == 0 {
+		return "none"
+	}
+
+	s := make([]string, len(gid))
+	for i, g := range gid {
+		s[i] = strconv.FormatUint(uint64(g), 10)
+	}
+	return strings.Join(s, ",")
+}
+
+// Write the DB to 'w' as CSV with a header row; packages are sorted by
+// name. The calling process (see WithSelf) isn't written.
+func (db *PackageDB) WriteCSV(w io.Writer) error {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	pv := sortedPkgs(db.byName)
+	db.mu.RUnlock()
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "uid", "version", "installer", "seinfo", "certhash", "path"})
+	for _, p := range pv {
+		if p.pseudo {
+			continue
+		}
+
+		ver := p.Version
+		if len(ver) == 0 && p.VersionCode != 0 {
+			ver = strconv.FormatInt(p.VersionCode, 10)
+		}
+
+		cw.Write([]string{p.Name, strconv.FormatUint(uint64(p.Uid), 10), ver,
+			p.Installer, p.SEinfo, hex.EncodeToString(p.Certhash), p.Path})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// Write the DB to 'w' in packages.xml format; packages are sorted by
+// name. Each distinct signing cert is written in full once and
+// referenced by its index thereafter - just like Android does. The
+// calling process (see WithSelf) isn't written.
+func (db *PackageDB) WriteXML(w io.Writer) error {
+	db.maybeRefresh()
+
+	db.mu.RLock()
+	pv := sortedPkgs(db.byName)
+	hdr := db.hdr
+	shared := make([]uint32, 0, len(db.shared))
+	for u := range db.shared {
+		shared = append(shared, u)
+	}
+	sort.Slice(shared, func(i, j int) bool {
+		return shared[i] < shared[j]
+	})
+	snames := make([]xSharedUser, len(shared))
+	for i, u := range shared {
+		snames[i] = xSharedUser{Name: db.shared[u], Uid: strconv.FormatUint(uint64(u), 10)}
+	}
+
+	var updated []xUpdatedPkg
+	for nm := range db.updated {
+		updated = append(updated, xUpdatedPkg{Name: nm})
+	}
+	sort.Slice(updated, func(i, j int) bool {
+		return updated[i].Name < updated[j].Name
+	})
+
+	var renamed []xRenamedPkg
+	for nw, old := range db.renamed {
+		renamed = append(renamed, xRenamedPkg{New: nw, Old: old})
+	}
+	sort.Slice(renamed, func(i, j int) bool {
+		return renamed[i].New < renamed[j].New
+	})
+	db.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(xml.Header)
+
+	e := xml.NewEncoder(bw)
+	e.Indent("", "    ")
+
+	root := xml.StartElement{Name: xml.Name{Local: "packages"}}
+	if err := e.EncodeToken(root); err != nil {
+		return err
+	}
+
+	if hdr != (Header{}) {
+		if err := e.EncodeElement(xmlHeader(hdr), xmlElem("version")); err != nil {
+			return err
+		}
+	}
+
+	// DER bytes -> cert index
+	keys := make(map[string]string)
+	for _, p := range pv {
+		if p.pseudo {
+			continue
+		}
+		if err := e.EncodeElement(xmlPkg(p, keys), xmlElem("package")); err != nil {
+			return err
+		}
+	}
+
+	for i := range updated {
+		if err := e.EncodeElement(&updated[i], xmlElem("updated-package")); err != nil {
+			return err
+		}
+	}
+
+	for i := range snames {
+		if err := e.EncodeElement(&snames[i], xmlElem("shared-user")); err != nil {
+			return err
+		}
+	}
+
+	for i := range renamed {
+		if err := e.EncodeElement(&renamed[i], xmlElem("renamed-package")); err != nil {
+			return err
+		}
+	}
+
+	if err := e.EncodeToken(root.End()); err != nil {
+		return err
+	}
+	if err := e.Flush(); err != nil {
+		return err
+	}
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+func xmlElem(nm string) xml.StartElement {
+	return xml.StartElement{Name: xml.Name{Local: nm}}
+}
+
+// Convert a header into its <version> attributes
+func xmlHeader(h Header) *xPackageVer {
+	x := &xPackageVer{
+		FP:      h.Fingerprint,
+		VolUUID: h.VolumeUuid,
+	}
+	if h.SdkVersion > 0 {
+		x.SdkVer = strconv.Itoa(h.SdkVersion)
+	}
+	if h.DatabaseVersion > 0 {
+		x.DBVer = strconv.Itoa(h.DatabaseVersion)
+	}
+	return x
+}
+
+// Convert a Pkg into a <package> element; 'keys' maps the DER bytes of
+// certs written so far to their index.
+func xmlPkg(p *Pkg, keys map[string]string) *xpkg {
+	x := &xpkg{
+		Name:        p.Name,
+		Path:        p.Path,
+		NativePath:  p.NativeLibraryPath,
+		PrimAbi:     p.PrimaryCpuAbi,
+		SecAbi:      p.SecondaryCpuAbi,
+		AbiOvr:      p.CpuAbiOverride,
+		VolUUID:     p.VolumeUuid,
+		PubFlags:    xmlFlags(p.Flags),
+		Inst:        p.Installer,
+		InstInit:    p.InitiatingInstaller,
+		InstOrig:    p.OriginatingInstaller,
+		InstallTime: hexTime(p.FirstInstallTime),
+		UpdateTime:  hexTime(p.LastUpdateTime),
+	}
+
+	if p.InstallReason != 0 {
+		x.InstReason = strconv.Itoa(p.InstallReason)
+	}
+	if p.IsOrphaned {
+		x.Orphaned = "true"
+	}
+
+	if p.SharedUid > 0 {
+		x.SharedUid = strconv.FormatUint(uint64(p.SharedUid), 10)
+	}
+	if p.Uid != p.SharedUid {
+		x.Uid = strconv.FormatUint(uint64(p.Uid), 10)
+	}
+
+	if len(p.Version) > 0 {
+		x.Version = p.Version
+		if p.VersionCode != 0 {
+			x.VerCode = strconv.FormatInt(p.VersionCode, 10)
+		}
+	} else if p.VersionCode != 0 {
+		x.Version = strconv.FormatInt(p.VersionCode, 10)
+	}
+
+	x.Enabled = xmlEnabled(p)
+	for _, nm := range p.Splits {
+		x.Splits = append(x.Splits, xitem{Name: nm})
+	}
+	for _, nm := range p.DisabledComponents {
+		x.DisabledComp = append(x.DisabledComp, xitem{Name: nm})
+	}
+	for _, nm := range p.EnabledComponents {
+		x.EnabledComp = append(x.EnabledComp, xitem{Name: nm})
+	}
+	for _, nm := range p.Permissions {
+		x.Perms = append(x.Perms, xperm{Name: nm, Granted: "true"})
+	}
+
+	certs, lineage := p.certDERs()
+	if len(certs) == 0 && p.Cert != nil {
+		certs = append(certs, p.Cert.Raw)
+	}
+	if len(certs) == 0 && p.SignerCount == 0 && len(p.SignatureSchemes) == 0 {
+		return x
+	}
+
+	s := &xsigs{Certs: xmlCerts(certs, keys)}
+	if p.SignerCount > 0 {
+		s.Count = strconv.Itoa(p.SignerCount)
+	}
+	if len(p.SignatureSchemes) > 0 {
+		s.Scheme = strings.TrimPrefix(p.SignatureSchemes[0], "v")
+	}
+
+	// Only packages that rotated their key have a lineage of their own
+	if len(lineage) > 0 && !slices.EqualFunc(lineage, certs, bytes.Equal) {
+		s.PastSigs = xmlCerts(lineage, keys)
+	}
+	x.Sigs = s
+	return x
+}
+
+// Convert DER encoded certs into <cert> elements; only the first
+// reference to a cert carries its key.
+func xmlCerts(certs [][]byte, keys map[string]string) []cert {
+	var v []cert
+	for _, der := range certs {
+		if idx, ok := keys[string(der)]; ok {
+			v = append(v, cert{Index: idx})
+			continue
+		}
+
+		idx := strconv.Itoa(len(keys))
+		keys[string(der)] = idx
+		v = append(v, cert{Index: idx, Cert: hex.EncodeToString(der)})
+	}
+	return v
+}
+
+// Encode the enabled state of p: the parsed state unless Enabled was
+// changed since (or p was made by hand). "" is the default state.
+func xmlEnabled(p *Pkg) string {
+	st := p.enabled
+	if p.Enabled != (st == EnabledStateDefault || st == EnabledStateEnabled) {
+		if p.Enabled {
+			return ""
+		}
+		return strconv.Itoa(EnabledStateDisabled)
+	}
+
+	if st == EnabledStateDefault {
+		return ""
+	}
+	return strconv.Itoa(st)
+}
+
+// Encode flags as a java int; zero yields ""
+func xmlFlags(f uint32) string {
+	if f == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(int32(f)))
+}
+
+// Encode t as hex milliseconds since epoch; zero time yields ""
+func hexTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(t.UnixMilli(), 16)
+}
@@ -0,0 +1,77 @@
+// zip.go -- read the package DB from a zip archive of a device dump
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Android package lives in android/pkg
+package pkg // android/pkg
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Where packages.xml and packages.list may live in an archive, in
+// order of preference
+var zipDirs = []string{"data/system", "system", ""}
+
+// Open the Android Package DB from packages.xml and packages.list in
+// the zip archive 'fn' - eg a forensic capture of /data/system. The
+// files are looked for under data/system/, system/ and the top of the
+// archive. Such a DB isn't tied to the archive and is never refreshed.
+func OpenPackageDBZip(fn string, opts ...Option) (*PackageDB, error) {
+	zr, err := zip.OpenReader(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		nm := path.Clean(strings.TrimPrefix(f.Name, "/"))
+		files[nm] = f
+	}
+
+	find := func(base string) (*zip.File, error) {
+		for _, d := range zipDirs {
+			if f, ok := files[path.Join(d, base)]; ok {
+				return f, nil
+			}
+		}
+		return nil, fmt.Errorf("%s: no %s in archive: %w", fn, base, fs.ErrNotExist)
+	}
+
+	xf, err := find("packages.xml")
+	if err != nil {
+		return nil, err
+	}
+	lf, err := find("packages.list")
+	if err != nil {
+		return nil, err
+	}
+
+	xml, err := xf.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", fn, xf.Name, err)
+	}
+	defer xml.Close()
+
+	list, err := lf.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", fn, lf.Name, err)
+	}
+	defer list.Close()
+
+	return OpenPackageDBReader(xml, list, opts...)
+}